@@ -1,6 +1,9 @@
 package main
 
 import (
+	"flag"
+	"fmt"
+	"github.com/miky4u2/RAagent/agent/audit"
 	"github.com/miky4u2/RAagent/agent/config"
 	"github.com/miky4u2/RAagent/agent/webserver"
 	"log"
@@ -13,12 +16,27 @@ const logMaxSize int64 = 500000
 
 func main() {
 
+	verifyAudit := flag.Bool("verify-audit", false, "verify the audit log chain and exit")
+	flag.Parse()
+
 	// Load configuration settings
 	err := config.Settings.Load()
 	if err != nil {
 		log.Fatal("Error loading config file. ", err)
 	}
 
+	// Verify audit log and exit if requested
+	if *verifyAudit {
+		count, err := audit.Verify(audit.Path())
+		fmt.Println(`Note: audit hashes are not keyed, this detects partial edits but not a log and head file rewritten together`)
+		if err != nil {
+			fmt.Println(`Audit log verification failed after`, count, `valid records :`, err)
+			os.Exit(1)
+		}
+		fmt.Println(`Audit log OK,`, count, `records verified`)
+		os.Exit(0)
+	}
+
 	// log to file is true, open log file and set log output to file
 	// If no log file path provided, use default
 	if config.Settings.LogToFile {
@@ -43,10 +61,17 @@ func main() {
 		log.SetOutput(f)
 	}
 
+	// Open audit log, which is never truncated
+	err = audit.Open()
+	if err != nil {
+		log.Fatal("Error opening audit log ", err)
+	}
+
 	// Start server
 	log.Println(`RAagent`, config.Version, `starting`)
 	err = webserver.Start()
 	if err != nil {
 		log.Fatal("Error starting agent ", config.Version, ` : `, err)
 	}
+	log.Println(`RAagent`, config.Version, `stopped`)
 }
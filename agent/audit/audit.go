@@ -0,0 +1,263 @@
+package audit
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"github.com/miky4u2/RAagent/agent/config"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Record is an entry of the audit log. Each record carries the hash of the
+// previous one, so that editing or removing a record breaks the chain
+//
+type Record struct {
+	Seq      uint64 `json:"seq"`
+	Time     string `json:"time"`
+	Event    string `json:"event"`
+	Client   string `json:"client"`
+	IP       string `json:"ip"`
+	Type     string `json:"type,omitempty"`
+	UUID     string `json:"uuid,omitempty"`
+	Module   string `json:"module,omitempty"`
+	Mode     string `json:"mode,omitempty"`
+	ArgsHash string `json:"argsHash,omitempty"`
+	Result   string `json:"result"`
+	Prev     string `json:"prev"`
+	Hash     string `json:"hash"`
+}
+
+// head holds the sequence and hash of the last record written, kept next to
+// the audit log so that truncation can be detected
+//
+type head struct {
+	Seq  uint64 `json:"seq"`
+	Hash string `json:"hash"`
+}
+
+// Audit log writer state
+var auditLog = struct {
+	sync.Mutex
+	file *os.File
+	path string
+	last head
+}{}
+
+// Path returns the path of the audit log
+//
+func Path() string {
+	if config.Settings.AuditLogFile != "" {
+		return config.Settings.AuditLogFile
+	}
+	return filepath.Join(config.AppBasePath, `log`, `audit.log`)
+}
+
+// Open opens the audit log for appending and restores the state of the chain.
+// The head file is trusted over the log itself, so records written after a
+// truncation do not hide it. An unreadable head file does not prevent the
+// agent from starting: the chain is restored from the log and a head mismatch
+// is recorded
+//
+func Open() error {
+	headProblem, err := open()
+	if err != nil {
+		return err
+	}
+	if headProblem != "" {
+		Log(Record{Event: `audit`, Client: `agent`, Result: `head mismatch: ` + headProblem})
+	}
+	return nil
+}
+
+// Opens the audit log. Returns the problem met reading an existing head file
+//
+func open() (string, error) {
+	auditLog.Lock()
+	defer auditLog.Unlock()
+
+	path := Path()
+	headProblem := ""
+	last, err := readHead(path)
+	if err != nil && !os.IsNotExist(err) {
+		headProblem = err.Error()
+		log.Println(`Audit log head file is unreadable, restoring the chain from the log :`, err)
+	}
+	if err != nil {
+		last, _, err = readChain(path)
+		if err != nil && !os.IsNotExist(err) {
+			log.Println(`Audit log chain is broken, appending after last valid record :`, err)
+		}
+	}
+
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return headProblem, err
+	}
+
+	auditLog.file = f
+	auditLog.path = path
+	auditLog.last = last
+	return headProblem, nil
+}
+
+// Log appends a record to the audit log. Sequence, time and hashes are set here
+//
+func Log(rec Record) {
+	auditLog.Lock()
+	defer auditLog.Unlock()
+
+	if auditLog.file == nil {
+		return
+	}
+
+	rec.Seq = auditLog.last.Seq + 1
+	rec.Time = time.Now().Format("2006-01-02 15:04:05")
+	rec.Prev = auditLog.last.Hash
+	rec.Hash = ""
+	rec.Hash = recordHash(rec)
+
+	line, err := json.Marshal(rec)
+	if err != nil {
+		log.Println(`Audit log error:`, err)
+		return
+	}
+	_, err = auditLog.file.Write(append(line, '\n'))
+	if err == nil {
+		err = auditLog.file.Sync()
+	}
+	if err != nil {
+		log.Println(`Audit log error:`, err)
+		return
+	}
+
+	auditLog.last = head{Seq: rec.Seq, Hash: rec.Hash}
+	err = writeHead(auditLog.path, auditLog.last)
+	if err != nil {
+		log.Println(`Audit log error:`, err)
+	}
+}
+
+// HashArgs returns the SHA-256 of task arguments, so they can be matched
+// without being disclosed in the audit log
+//
+func HashArgs(args []string) string {
+	if len(args) == 0 {
+		return ""
+	}
+	data, _ := json.Marshal(args)
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// Verify checks the audit log chain and that it ends with the record recorded
+// in the head file. Returns the number of valid records and the first problem found
+//
+func Verify(path string) (uint64, error) {
+	last, count, err := readChain(path)
+	if err != nil {
+		return count, err
+	}
+
+	h, err := readHead(path)
+	if os.IsNotExist(err) {
+		if count > 0 {
+			return count, errors.New(`head file is missing`)
+		}
+		return count, nil
+	}
+	if err != nil {
+		return count, err
+	}
+	if h.Seq != last.Seq || h.Hash != last.Hash {
+		return count, errors.New(`log ends at record ` + strconv.FormatUint(last.Seq, 10) + ` but head file expects record ` + strconv.FormatUint(h.Seq, 10) + `, records were removed or altered`)
+	}
+	return count, nil
+}
+
+// Reads the audit log and checks its chain. Returns the last valid record head,
+// the number of valid records and an error describing the first broken record
+//
+func readChain(path string) (head, uint64, error) {
+	var last head
+	var count uint64
+
+	f, err := os.Open(path)
+	if err != nil {
+		return last, count, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := scanner.Bytes()
+		lineNum := strconv.FormatUint(count+1, 10)
+
+		rec := Record{}
+		err = json.Unmarshal(line, &rec)
+		if err != nil {
+			return last, count, errors.New(`line ` + lineNum + ` is not a valid record`)
+		}
+
+		// A record must be re-encoded to the exact same line, which rules out added fields
+		canonical, _ := json.Marshal(rec)
+		if string(canonical) != string(line) {
+			return last, count, errors.New(`line ` + lineNum + ` was modified`)
+		}
+		if rec.Seq != last.Seq+1 || rec.Prev != last.Hash {
+			return last, count, errors.New(`line ` + lineNum + ` does not follow record ` + strconv.FormatUint(last.Seq, 10) + `, records were removed or inserted`)
+		}
+		hash := rec.Hash
+		rec.Hash = ""
+		if recordHash(rec) != hash {
+			return last, count, errors.New(`line ` + lineNum + ` hash mismatch, record was modified`)
+		}
+
+		last = head{Seq: rec.Seq, Hash: hash}
+		count++
+	}
+	return last, count, scanner.Err()
+}
+
+// Computes the hash of a record, which must have an empty Hash field
+//
+func recordHash(rec Record) string {
+	data, _ := json.Marshal(rec)
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// Reads the head file of an audit log
+//
+func readHead(path string) (head, error) {
+	h := head{}
+	data, err := ioutil.ReadFile(path + `.head`)
+	if err != nil {
+		return h, err
+	}
+	err = json.Unmarshal(data, &h)
+	return h, err
+}
+
+// Writes the head file of an audit log atomically
+//
+func writeHead(path string, h head) error {
+	data, err := json.Marshal(h)
+	if err != nil {
+		return err
+	}
+	tmpPath := path + `.head.tmp`
+	err = ioutil.WriteFile(tmpPath, data, 0600)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, path+`.head`)
+}
@@ -0,0 +1,105 @@
+package auth
+
+import (
+	"github.com/miky4u2/RAagent/agent/common"
+	"github.com/miky4u2/RAagent/agent/config"
+	"log"
+	"net/http"
+)
+
+// Endpoint groups, used to select who may call an endpoint and
+// whether requests to it must be signed
+const (
+	// GroupTasks covers /tasks/* endpoints
+	GroupTasks = `tasks`
+	// GroupModules covers /modules/* endpoints
+	GroupModules = `modules`
+	// GroupServer covers the RAserver reserved /update and /ctl endpoints
+	GroupServer = `server`
+)
+
+// Identity describes who sent a request
+//
+type Identity struct {
+	IP          string
+	KeyID       string
+	CertSubject string
+	// Module patterns the caller may run, nil when not restricted
+	modules []string
+}
+
+// String returns a short description of the identity for logs and task records
+//
+func (id *Identity) String() string {
+	if id.CertSubject != "" {
+		return `cert:` + id.CertSubject + `@` + id.IP
+	}
+	if id.KeyID != "" {
+		return `key:` + id.KeyID + `@` + id.IP
+	}
+	return id.IP
+}
+
+// CanRunModule checks if the caller's client certificate may run a module
+//
+func (id *Identity) CanRunModule(name string) bool {
+	return id.modules == nil || matchModule(id.modules, name)
+}
+
+// Authorize checks that a request may call an endpoint of provided group.
+// Requests from deniedIPs are never authorized.
+// A request with a verified client certificate mapped in clientCerts is
+// authorized for the groups of its mapping only.
+// A request carrying a valid signature is authorized whatever its origin,
+// for the groups of its key only.
+// Other requests are authorized when the group does not require signing
+// and the remote IP is allowed for the group (serverIP for the server group,
+// allowedIPs otherwise). Returns the identity of the caller and false if the
+// request is not authorized
+//
+func Authorize(req *http.Request, group string) (*Identity, bool) {
+	id := &Identity{IP: common.GetRemoteIP(req)}
+
+	if common.IsIPDenied(req) {
+		log.Println(`Rejected request to`, req.URL.Path, `from denied IP`, id.IP)
+		return id, false
+	}
+
+	if cert := clientCertificate(req); cert != nil {
+		subject, perms := certificatePermissions(cert)
+		if perms != nil {
+			id.CertSubject = subject
+			id.modules = perms.Modules
+			if !common.Find(perms.Groups, group) {
+				log.Println(`Rejected request to`, req.URL.Path, `from`, id.String(), `: endpoint not permitted for certificate`)
+				return id, false
+			}
+			return id, true
+		}
+	}
+
+	if isSigned(req) {
+		keyID, groups, err := verifySignature(req)
+		if err != nil {
+			log.Println(`Rejected signed request to`, req.URL.Path, `from`, id.IP, `:`, err)
+			return id, false
+		}
+		id.KeyID = keyID
+		if !common.Find(groups, group) {
+			log.Println(`Rejected request to`, req.URL.Path, `from`, id.String(), `: endpoint not permitted for key`)
+			return id, false
+		}
+		return id, true
+	}
+
+	if common.Find(config.Settings.RequireSignature, group) {
+		log.Println(`Rejected unsigned request to`, req.URL.Path, `from`, id.IP, `: signature required`)
+		return id, false
+	}
+
+	allowedIPs := config.Settings.AllowedIPs
+	if group == GroupServer {
+		allowedIPs = config.Settings.ServerIP
+	}
+	return id, common.IsIPAllowed(req, allowedIPs)
+}
@@ -0,0 +1,61 @@
+package auth
+
+import (
+	"crypto/x509"
+	"github.com/miky4u2/RAagent/agent/config"
+	"net/http"
+	"path/filepath"
+)
+
+// Returns the verified client certificate of a request, or nil
+//
+func clientCertificate(req *http.Request) *x509.Certificate {
+	if req.TLS == nil || len(req.TLS.VerifiedChains) == 0 || len(req.TLS.VerifiedChains[0]) == 0 {
+		return nil
+	}
+	return req.TLS.VerifiedChains[0][0]
+}
+
+// Returns the names a client certificate can be mapped by:
+// its subject common name and its DNS, email and URI SANs
+//
+func certificateNames(cert *x509.Certificate) []string {
+	names := []string{}
+	if cert.Subject.CommonName != "" {
+		names = append(names, cert.Subject.CommonName)
+	}
+	names = append(names, cert.DNSNames...)
+	names = append(names, cert.EmailAddresses...)
+	for _, uri := range cert.URIs {
+		names = append(names, uri.String())
+	}
+	return names
+}
+
+// Finds the permissions configured for a client certificate.
+// Returns the matched subject and nil if the certificate is not mapped
+//
+func certificatePermissions(cert *x509.Certificate) (string, *config.ClientCert) {
+	names := certificateNames(cert)
+	for i := range config.Settings.ClientCerts {
+		cc := &config.Settings.ClientCerts[i]
+		for _, name := range names {
+			if name == cc.Subject {
+				return name, cc
+			}
+		}
+	}
+	return "", nil
+}
+
+// Checks if a module name matches any of provided patterns.
+// Patterns use filepath.Match syntax, e.g. backup_*
+//
+func matchModule(patterns []string, name string) bool {
+	for _, pattern := range patterns {
+		if ok, _ := filepath.Match(pattern, name); ok {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,83 @@
+package auth
+
+import (
+	"errors"
+	"github.com/miky4u2/RAagent/agent/common"
+	"github.com/miky4u2/RAagent/agent/config"
+	"net"
+	"strconv"
+)
+
+// Permit checks the client policies for a task the caller wants to run.
+// Returns an error describing why the task is denied, or nil if it is permitted.
+// When no policies are configured, every task is permitted, unless the module is
+// not allowed for the caller's client certificate
+//
+func (id *Identity) Permit(module string, mode string, args []string) error {
+	if !id.CanRunModule(module) {
+		return errors.New(`module '` + module + `' is not permitted for certificate ` + id.CertSubject)
+	}
+
+	if len(config.Settings.Policies) == 0 {
+		return nil
+	}
+
+	var reasons []string
+	for i := range config.Settings.Policies {
+		p := &config.Settings.Policies[i]
+		if !id.matchPolicy(p) {
+			continue
+		}
+		reason := permitByPolicy(p, module, mode, args)
+		if reason == "" {
+			return nil
+		}
+		reasons = append(reasons, reason)
+	}
+
+	if len(reasons) == 0 {
+		return errors.New(`no policy applies to client ` + id.String())
+	}
+	if len(reasons) == 1 {
+		return errors.New(reasons[0])
+	}
+	return errors.New(`no policy permits module '` + module + `' in ` + mode + ` mode for client ` + id.String())
+}
+
+// Checks if a policy applies to the caller, by IP/CIDR, key ID or certificate subject
+//
+func (id *Identity) matchPolicy(p *config.Policy) bool {
+	if ip := net.ParseIP(id.IP); ip != nil && common.IPInList(ip, p.IPs) {
+		return true
+	}
+	if id.KeyID != "" && common.Find(p.KeyIDs, id.KeyID) {
+		return true
+	}
+	if id.CertSubject != "" && common.Find(p.CertSubjects, id.CertSubject) {
+		return true
+	}
+	return false
+}
+
+// Checks a task against a policy. Returns the reason the policy denies the task,
+// or an empty string if the policy permits it
+//
+func permitByPolicy(p *config.Policy, module string, mode string, args []string) string {
+	if !matchModule(p.Modules, module) {
+		return `module '` + module + `' is not permitted by policy '` + p.Name + `'`
+	}
+	if len(p.Modes) > 0 && !common.Find(p.Modes, mode) {
+		return `mode '` + mode + `' is not permitted by policy '` + p.Name + `'`
+	}
+	if p.Args != nil {
+		if len(args) > len(p.Args) {
+			return `policy '` + p.Name + `' permits at most ` + strconv.Itoa(len(p.Args)) + ` arguments`
+		}
+		for i, arg := range args {
+			if !p.MatchArg(i, arg) {
+				return `'args[` + strconv.Itoa(i) + `]' is not permitted by policy '` + p.Name + `'`
+			}
+		}
+	}
+	return ""
+}
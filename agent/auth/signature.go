@@ -0,0 +1,143 @@
+package auth
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"github.com/miky4u2/RAagent/agent/config"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"regexp"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Request signing headers
+const (
+	HeaderKeyID     = `X-RA-Key-ID`
+	HeaderTimestamp = `X-RA-Timestamp`
+	HeaderNonce     = `X-RA-Nonce`
+	HeaderSignature = `X-RA-Signature`
+)
+
+// Maximum size of a signed request body
+const maxSignedBodySize = 10 << 20
+
+// Nonces must be 16 to 128 chars of [a-zA-Z0-9-_]
+var nonceRegex = regexp.MustCompile(`^[a-zA-Z0-9\-_]{16,128}$`)
+
+// nonces already used, with the time after which they can be forgotten.
+// They are only kept in memory, a restart forgets them
+//
+var nonces = struct {
+	sync.Mutex
+	seen map[string]time.Time
+}{seen: make(map[string]time.Time)}
+
+// Checks if a request carries a signature
+//
+func isSigned(req *http.Request) bool {
+	return req.Header.Get(HeaderSignature) != ""
+}
+
+// StringToSign builds the canonical string signed by clients:
+// method, request URI, timestamp, nonce and the hex encoded SHA-256 of the body,
+// separated by new lines
+//
+func StringToSign(method string, requestURI string, timestamp string, nonce string, body []byte) string {
+	bodyHash := sha256.Sum256(body)
+	return method + "\n" + requestURI + "\n" + timestamp + "\n" + nonce + "\n" + hex.EncodeToString(bodyHash[:])
+}
+
+// Sign returns the hex encoded HMAC-SHA256 of the canonical string with provided secret
+//
+func Sign(secret string, stringToSign string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(stringToSign))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Verifies the signature of a request. The request body is read and replaced
+// so that handlers can still read it. Returns the ID of the key used and the
+// endpoint groups it may call
+//
+func verifySignature(req *http.Request) (string, []string, error) {
+	keyID := req.Header.Get(HeaderKeyID)
+	timestamp := req.Header.Get(HeaderTimestamp)
+	nonce := req.Header.Get(HeaderNonce)
+	signature := req.Header.Get(HeaderSignature)
+
+	secret := ""
+	var groups []string
+	for _, key := range config.Settings.HMACKeys {
+		if key.ID == keyID {
+			secret = key.Secret
+			groups = key.Groups
+			break
+		}
+	}
+	if secret == "" {
+		return "", nil, errors.New(`unknown key ID '` + keyID + `'`)
+	}
+
+	// Reject stale or future timestamps
+	ts, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return "", nil, errors.New(`invalid timestamp`)
+	}
+	maxAge := time.Duration(config.Settings.SignatureMaxAge) * time.Second
+	age := time.Now().Sub(time.Unix(ts, 0))
+	if age > maxAge || age < -maxAge {
+		return "", nil, errors.New(`stale timestamp`)
+	}
+
+	if !nonceRegex.MatchString(nonce) {
+		return "", nil, errors.New(`invalid nonce`)
+	}
+
+	// Read the body and give it back to the request
+	body, err := ioutil.ReadAll(io.LimitReader(req.Body, maxSignedBodySize+1))
+	if err != nil {
+		return "", nil, errors.New(`cannot read body: ` + err.Error())
+	}
+	if len(body) > maxSignedBodySize {
+		return "", nil, errors.New(`body too large`)
+	}
+	req.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+	expected := Sign(secret, StringToSign(req.Method, req.URL.RequestURI(), timestamp, nonce, body))
+	if !hmac.Equal([]byte(expected), []byte(signature)) {
+		return "", nil, errors.New(`invalid signature`)
+	}
+
+	// Only accept each nonce once while its timestamp is valid
+	if !useNonce(keyID+`/`+nonce, time.Unix(ts, 0).Add(maxAge)) {
+		return "", nil, errors.New(`replayed nonce`)
+	}
+
+	return keyID, groups, nil
+}
+
+// Records a nonce as used. Returns false if it was already used
+//
+func useNonce(nonce string, expiry time.Time) bool {
+	nonces.Lock()
+	defer nonces.Unlock()
+
+	now := time.Now()
+	for n, e := range nonces.seen {
+		if now.After(e) {
+			delete(nonces.seen, n)
+		}
+	}
+
+	if _, ok := nonces.seen[nonce]; ok {
+		return false
+	}
+	nonces.seen[nonce] = expiry
+	return true
+}
@@ -0,0 +1,180 @@
+package auth
+
+import (
+	"encoding/json"
+	"github.com/miky4u2/RAagent/agent/config"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+const (
+	testSecret      = `0123456789abcdef0123`
+	testOtherSecret = `fedcba9876543210fedc`
+)
+
+// Sets up one key per endpoint group and resets the nonce cache
+//
+func setupKeys(t *testing.T) {
+	t.Helper()
+	keys := `{"hmacKeys": [
+		{"id": "tasks-key", "secret": "` + testSecret + `", "groups": ["tasks"]},
+		{"id": "server-key", "secret": "` + testOtherSecret + `", "groups": ["server"]}
+	], "signatureMaxAge": 300}`
+	config.Settings.HMACKeys = nil
+	err := json.Unmarshal([]byte(keys), &config.Settings)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { config.Settings.HMACKeys = nil })
+
+	nonces.Lock()
+	nonces.seen = make(map[string]time.Time)
+	nonces.Unlock()
+}
+
+// Builds a request to uri signed with keyID and secret
+//
+func signedRequest(uri string, keyID string, secret string, ts time.Time, nonce string, body string) *http.Request {
+	timestamp := strconv.FormatInt(ts.Unix(), 10)
+	req := httptest.NewRequest(`POST`, uri, strings.NewReader(body))
+	req.Header.Set(HeaderKeyID, keyID)
+	req.Header.Set(HeaderTimestamp, timestamp)
+	req.Header.Set(HeaderNonce, nonce)
+	req.Header.Set(HeaderSignature, Sign(secret, StringToSign(`POST`, uri, timestamp, nonce, []byte(body))))
+	return req
+}
+
+func TestVerifySignature(t *testing.T) {
+	now := time.Now()
+	body := `{"uuid":"8db6408d-c4e9-4144-92aa-46d1201a88d0"}`
+
+	tests := []struct {
+		name  string
+		req   func() *http.Request
+		keyID string
+		err   string
+	}{
+		{`valid`, func() *http.Request {
+			return signedRequest(`/tasks/status`, `tasks-key`, testSecret, now, `nonce-0000000001`, body)
+		}, `tasks-key`, ``},
+		{`slight clock skew`, func() *http.Request {
+			return signedRequest(`/tasks/status`, `tasks-key`, testSecret, now.Add(time.Minute), `nonce-0000000002`, body)
+		}, `tasks-key`, ``},
+		{`unknown key`, func() *http.Request {
+			return signedRequest(`/tasks/status`, `other-key`, testSecret, now, `nonce-0000000003`, body)
+		}, ``, `unknown key ID`},
+		{`wrong secret`, func() *http.Request {
+			return signedRequest(`/tasks/status`, `tasks-key`, testOtherSecret, now, `nonce-0000000004`, body)
+		}, ``, `invalid signature`},
+		{`stale timestamp`, func() *http.Request {
+			return signedRequest(`/tasks/status`, `tasks-key`, testSecret, now.Add(-301*time.Second), `nonce-0000000005`, body)
+		}, ``, `stale timestamp`},
+		{`future timestamp`, func() *http.Request {
+			return signedRequest(`/tasks/status`, `tasks-key`, testSecret, now.Add(301*time.Second), `nonce-0000000006`, body)
+		}, ``, `stale timestamp`},
+		{`invalid timestamp`, func() *http.Request {
+			req := signedRequest(`/tasks/status`, `tasks-key`, testSecret, now, `nonce-0000000007`, body)
+			req.Header.Set(HeaderTimestamp, `yesterday`)
+			return req
+		}, ``, `invalid timestamp`},
+		{`short nonce`, func() *http.Request {
+			return signedRequest(`/tasks/status`, `tasks-key`, testSecret, now, `nonce`, body)
+		}, ``, `invalid nonce`},
+		{`tampered body`, func() *http.Request {
+			req := signedRequest(`/tasks/status`, `tasks-key`, testSecret, now, `nonce-0000000008`, body)
+			req.Body = ioutil.NopCloser(strings.NewReader(`{"uuid":"00000000-0000-0000-0000-000000000000"}`))
+			return req
+		}, ``, `invalid signature`},
+		{`tampered URI`, func() *http.Request {
+			req := signedRequest(`/tasks/status`, `tasks-key`, testSecret, now, `nonce-0000000009`, body)
+			req.URL.Path = `/tasks/cancel`
+			return req
+		}, ``, `invalid signature`},
+		{`tampered timestamp`, func() *http.Request {
+			req := signedRequest(`/tasks/status`, `tasks-key`, testSecret, now, `nonce-0000000010`, body)
+			req.Header.Set(HeaderTimestamp, strconv.FormatInt(now.Unix()+1, 10))
+			return req
+		}, ``, `invalid signature`},
+		{`replayed nonce`, func() *http.Request {
+			return signedRequest(`/tasks/status`, `tasks-key`, testSecret, now, `nonce-0000000001`, body)
+		}, ``, `replayed nonce`},
+		{`same nonce with another key`, func() *http.Request {
+			return signedRequest(`/tasks/status`, `server-key`, testOtherSecret, now, `nonce-0000000001`, body)
+		}, `server-key`, ``},
+	}
+
+	setupKeys(t)
+	for _, test := range tests {
+		req := test.req()
+		keyID, _, err := verifySignature(req)
+		if test.err == `` {
+			if err != nil || keyID != test.keyID {
+				t.Errorf(`%s: got %q, %v, want %q`, test.name, keyID, err, test.keyID)
+				continue
+			}
+			// The body is given back to handlers
+			read, _ := ioutil.ReadAll(req.Body)
+			if string(read) != body {
+				t.Errorf(`%s: handlers read body %q, want %q`, test.name, read, body)
+			}
+			continue
+		}
+		if err == nil || !strings.Contains(err.Error(), test.err) {
+			t.Errorf(`%s: got error %v, want %q`, test.name, err, test.err)
+		}
+	}
+}
+
+func TestUseNonce(t *testing.T) {
+	setupKeys(t)
+	now := time.Now()
+	if !useNonce(`key/expired`, now.Add(-time.Second)) {
+		t.Fatal(`first use of a nonce was rejected`)
+	}
+	if !useNonce(`key/valid`, now.Add(time.Minute)) {
+		t.Fatal(`first use of a nonce was rejected`)
+	}
+	if useNonce(`key/valid`, now.Add(time.Minute)) {
+		t.Error(`second use of a nonce was accepted`)
+	}
+	// Expired nonces are forgotten, their timestamp is stale anyway
+	if !useNonce(`key/expired`, now.Add(time.Minute)) {
+		t.Error(`expired nonce was not forgotten`)
+	}
+}
+
+func TestAuthorizeSignedGroups(t *testing.T) {
+	tests := []struct {
+		name   string
+		keyID  string
+		secret string
+		group  string
+		ok     bool
+	}{
+		{`tasks key on tasks`, `tasks-key`, testSecret, GroupTasks, true},
+		{`tasks key on modules`, `tasks-key`, testSecret, GroupModules, false},
+		{`tasks key on server`, `tasks-key`, testSecret, GroupServer, false},
+		{`server key on server`, `server-key`, testOtherSecret, GroupServer, true},
+		{`server key on tasks`, `server-key`, testOtherSecret, GroupTasks, false},
+		{`bad signature`, `server-key`, testSecret, GroupServer, false},
+	}
+
+	setupKeys(t)
+	for i, test := range tests {
+		nonce := `group-nonce-` + strconv.Itoa(1000+i)
+		req := signedRequest(`/update`, test.keyID, test.secret, time.Now(), nonce, `{}`)
+		req.RemoteAddr = `192.0.2.1:5000`
+		id, ok := Authorize(req, test.group)
+		if ok != test.ok {
+			t.Errorf(`%s: authorized %v, want %v`, test.name, ok, test.ok)
+		}
+		if ok && id.KeyID != test.keyID {
+			t.Errorf(`%s: identity key %q, want %q`, test.name, id.KeyID, test.keyID)
+		}
+	}
+}
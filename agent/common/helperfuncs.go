@@ -1,9 +1,12 @@
 package common
 
 import (
+	"errors"
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"strconv"
+	"strings"
 	"time"
 )
 
@@ -46,3 +49,48 @@ func DeleteOldFiles(dir string, days int) {
 	}
 	return
 }
+
+// CompareVersions compares two dotted numeric versions such as 0.1.1.
+// Returns -1, 0 or 1 when a is older than, the same as or newer than b.
+// Missing trailing numbers count as 0
+//
+func CompareVersions(a string, b string) (int, error) {
+	aNums, err := parseVersion(a)
+	if err != nil {
+		return 0, err
+	}
+	bNums, err := parseVersion(b)
+	if err != nil {
+		return 0, err
+	}
+	for i := 0; i < len(aNums) || i < len(bNums); i++ {
+		aNum, bNum := 0, 0
+		if i < len(aNums) {
+			aNum = aNums[i]
+		}
+		if i < len(bNums) {
+			bNum = bNums[i]
+		}
+		if aNum < bNum {
+			return -1, nil
+		}
+		if aNum > bNum {
+			return 1, nil
+		}
+	}
+	return 0, nil
+}
+
+// Splits a dotted numeric version into its numbers
+//
+func parseVersion(version string) ([]int, error) {
+	var nums []int
+	for _, part := range strings.Split(version, `.`) {
+		num, err := strconv.Atoi(part)
+		if err != nil || num < 0 || strings.HasPrefix(part, `+`) {
+			return nil, errors.New(`invalid version '` + version + `'`)
+		}
+		nums = append(nums, num)
+	}
+	return nums, nil
+}
@@ -1,22 +1,134 @@
 package common
 
 import (
+	"github.com/miky4u2/RAagent/agent/config"
 	"net"
 	"net/http"
+	"strings"
 )
 
-// IsIPAllowed checks if Remote IP is in a slice of allowedIPs
+// IsIPAllowed checks if the client IP is in a slice of allowedIPs.
+// Entries can be IPs or CIDR ranges. Denied IPs are never allowed
 //
 func IsIPAllowed(req *http.Request, allowedIPs []string) bool {
+	ip := ClientIP(req)
+	if ip == nil || IsIPDenied(req) {
+		return false
+	}
+	return IPInList(ip, allowedIPs)
+}
+
+// IsIPDenied checks if the client IP is in deniedIPs
+//
+func IsIPDenied(req *http.Request) bool {
+	ip := ClientIP(req)
+	return ip != nil && IPInList(ip, config.Settings.DeniedIPs)
+}
+
+// GetRemoteIP returns the client IP of a request or "unknown"
+//
+func GetRemoteIP(req *http.Request) string {
+	ip := ClientIP(req)
+	if ip == nil {
+		return "unknown"
+	}
+	return ip.String()
+}
+
+// ClientIP returns the IP of the client which sent a request.
+// When the request comes from one of the trustedProxies, the client IP is taken
+// from the Forwarded or X-Forwarded-For header: the rightmost address which is not
+// a trusted proxy. IPv4-mapped IPv6 addresses are returned as IPv4
+//
+func ClientIP(req *http.Request) net.IP {
 	remoteAddress, _, err := net.SplitHostPort(req.RemoteAddr)
 	if err != nil {
-		return false
+		return nil
+	}
+	ip := normalizeIP(net.ParseIP(remoteAddress))
+	if ip == nil || !IPInList(ip, config.Settings.TrustedProxies) {
+		return ip
 	}
 
-	userIP := net.ParseIP(remoteAddress).String()
+	chain := forwardedFor(req)
+	for i := len(chain) - 1; i >= 0; i-- {
+		hop := normalizeIP(net.ParseIP(chain[i]))
+		if hop == nil {
+			break
+		}
+		ip = hop
+		if !IPInList(ip, config.Settings.TrustedProxies) {
+			break
+		}
+	}
+	return ip
+}
 
-	if !Find(allowedIPs, userIP) {
-		return false
+// IPInList checks if an IP matches any IP or CIDR range of a list
+//
+func IPInList(ip net.IP, list []string) bool {
+	for _, entry := range list {
+		if strings.Contains(entry, `/`) {
+			_, ipNet, err := net.ParseCIDR(entry)
+			if err == nil && ipNet.Contains(ip) {
+				return true
+			}
+			continue
+		}
+		if entryIP := normalizeIP(net.ParseIP(entry)); entryIP != nil && entryIP.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns IPv4-mapped IPv6 addresses as IPv4
+//
+func normalizeIP(ip net.IP) net.IP {
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4
+	}
+	return ip
+}
+
+// Returns the addresses listed by the Forwarded header, or by the X-Forwarded-For
+// header when there is no Forwarded header, from the client to the last proxy
+//
+func forwardedFor(req *http.Request) []string {
+	var chain []string
+
+	if forwarded := req.Header.Values("Forwarded"); len(forwarded) > 0 {
+		for _, element := range strings.Split(strings.Join(forwarded, ","), ",") {
+			for _, pair := range strings.Split(element, ";") {
+				kv := strings.SplitN(strings.TrimSpace(pair), "=", 2)
+				if len(kv) != 2 || !strings.EqualFold(kv[0], "for") {
+					continue
+				}
+				chain = append(chain, forwardedNode(kv[1]))
+			}
+		}
+		return chain
+	}
+
+	for _, header := range req.Header.Values("X-Forwarded-For") {
+		for _, hop := range strings.Split(header, ",") {
+			chain = append(chain, strings.TrimSpace(hop))
+		}
+	}
+	return chain
+}
+
+// Extracts the IP of a Forwarded header node, e.g. "[2001:db8::17]:4711" or 192.0.2.60:80
+//
+func forwardedNode(node string) string {
+	node = strings.Trim(node, `"`)
+	if strings.HasPrefix(node, `[`) {
+		if i := strings.Index(node, `]`); i > 0 {
+			return node[1:i]
+		}
+	}
+	if host, _, err := net.SplitHostPort(node); err == nil {
+		return host
 	}
-	return true
+	return node
 }
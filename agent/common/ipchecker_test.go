@@ -0,0 +1,80 @@
+package common
+
+import (
+	"github.com/miky4u2/RAagent/agent/config"
+	"net"
+	"net/http"
+	"testing"
+)
+
+func TestClientIP(t *testing.T) {
+	config.Settings.TrustedProxies = []string{`10.0.0.0/8`, `2001:db8:1::1`}
+	defer func() { config.Settings.TrustedProxies = nil }()
+
+	tests := []struct {
+		name       string
+		remoteAddr string
+		headers    map[string][]string
+		want       string
+	}{
+		{`direct client`, `192.0.2.1:5000`, nil, `192.0.2.1`},
+		{`no port`, `192.0.2.1`, nil, `<nil>`},
+		{`IPv4-mapped IPv6`, `[::ffff:192.0.2.1]:5000`, nil, `192.0.2.1`},
+		{`spoofed X-Forwarded-For from untrusted peer`, `192.0.2.1:5000`, map[string][]string{`X-Forwarded-For`: {`198.51.100.7`}}, `192.0.2.1`},
+		{`spoofed Forwarded from untrusted peer`, `192.0.2.1:5000`, map[string][]string{`Forwarded`: {`for=198.51.100.7`}}, `192.0.2.1`},
+		{`trusted proxy`, `10.0.0.1:5000`, map[string][]string{`X-Forwarded-For`: {`198.51.100.7`}}, `198.51.100.7`},
+		{`trusted proxy without header`, `10.0.0.1:5000`, nil, `10.0.0.1`},
+		{`client spoofing behind trusted proxy`, `10.0.0.1:5000`, map[string][]string{`X-Forwarded-For`: {`203.0.113.9, 198.51.100.7`}}, `198.51.100.7`},
+		{`several trusted proxies`, `10.0.0.1:5000`, map[string][]string{`X-Forwarded-For`: {`203.0.113.9, 198.51.100.7, 10.1.2.3, 10.0.0.2`}}, `198.51.100.7`},
+		{`several X-Forwarded-For headers`, `10.0.0.1:5000`, map[string][]string{`X-Forwarded-For`: {`203.0.113.9`, `198.51.100.7, 10.0.0.2`}}, `198.51.100.7`},
+		{`only trusted proxies`, `10.0.0.1:5000`, map[string][]string{`X-Forwarded-For`: {`10.0.0.3, 10.0.0.2`}}, `10.0.0.3`},
+		{`trusted IPv6 proxy`, `[2001:db8:1::1]:5000`, map[string][]string{`X-Forwarded-For`: {`2001:db8:2::5`}}, `2001:db8:2::5`},
+		{`invalid hop`, `10.0.0.1:5000`, map[string][]string{`X-Forwarded-For`: {`198.51.100.7, garbage`}}, `10.0.0.1`},
+		{`empty hop`, `10.0.0.1:5000`, map[string][]string{`X-Forwarded-For`: {`198.51.100.7,`}}, `10.0.0.1`},
+		{`Forwarded`, `10.0.0.1:5000`, map[string][]string{`Forwarded`: {`for=192.0.2.60;proto=http;by=203.0.113.43`}}, `192.0.2.60`},
+		{`Forwarded with port`, `10.0.0.1:5000`, map[string][]string{`Forwarded`: {`for="192.0.2.60:4711"`}}, `192.0.2.60`},
+		{`Forwarded IPv6`, `10.0.0.1:5000`, map[string][]string{`Forwarded`: {`for="[2001:db8:cafe::17]:4711"`}}, `2001:db8:cafe::17`},
+		{`Forwarded case insensitive`, `10.0.0.1:5000`, map[string][]string{`Forwarded`: {`For=192.0.2.60`}}, `192.0.2.60`},
+		{`Forwarded chain`, `10.0.0.1:5000`, map[string][]string{`Forwarded`: {`for=203.0.113.9, for=198.51.100.7`, `for=10.0.0.2`}}, `198.51.100.7`},
+		{`Forwarded preferred to X-Forwarded-For`, `10.0.0.1:5000`, map[string][]string{`Forwarded`: {`for=192.0.2.60`}, `X-Forwarded-For`: {`198.51.100.7`}}, `192.0.2.60`},
+		{`Forwarded obfuscated node`, `10.0.0.1:5000`, map[string][]string{`Forwarded`: {`for=_hidden`}}, `10.0.0.1`},
+		{`Forwarded unknown node`, `10.0.0.1:5000`, map[string][]string{`Forwarded`: {`for=198.51.100.7, for=unknown`}}, `10.0.0.1`},
+		{`Forwarded empty value`, `10.0.0.1:5000`, map[string][]string{`Forwarded`: {`for=`}}, `10.0.0.1`},
+		{`Forwarded token without value`, `10.0.0.1:5000`, map[string][]string{`Forwarded`: {`for;proto=https`}}, `10.0.0.1`},
+		{`Forwarded without for`, `10.0.0.1:5000`, map[string][]string{`Forwarded`: {`by=203.0.113.43;proto=https`}}, `10.0.0.1`},
+		{`Forwarded unterminated IPv6`, `10.0.0.1:5000`, map[string][]string{`Forwarded`: {`for="[2001:db8:cafe::17`}}, `10.0.0.1`},
+		{`Forwarded garbage around pairs`, `10.0.0.1:5000`, map[string][]string{`Forwarded`: {`;;junk; for=192.0.2.60 ;`}}, `192.0.2.60`},
+	}
+
+	for _, test := range tests {
+		req := &http.Request{RemoteAddr: test.remoteAddr, Header: http.Header(test.headers)}
+		if req.Header == nil {
+			req.Header = http.Header{}
+		}
+		if got := ClientIP(req).String(); got != test.want {
+			t.Errorf(`%s: got %s, want %s`, test.name, got, test.want)
+		}
+	}
+}
+
+func TestIPInList(t *testing.T) {
+	list := []string{`192.0.2.1`, `198.51.100.0/24`, `2001:db8::/32`, `::ffff:203.0.113.5`, `invalid`, `10.0.0.0/33`}
+	tests := []struct {
+		ip   string
+		want bool
+	}{
+		{`192.0.2.1`, true},
+		{`192.0.2.2`, false},
+		{`198.51.100.200`, true},
+		{`198.51.101.1`, false},
+		{`2001:db8::5`, true},
+		{`2001:db9::5`, false},
+		{`203.0.113.5`, true},
+		{`10.0.0.1`, false},
+	}
+	for _, test := range tests {
+		if got := IPInList(normalizeIP(net.ParseIP(test.ip)), list); got != test.want {
+			t.Errorf(`IPInList(%s) = %v, want %v`, test.ip, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,30 @@
+package common
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"github.com/miky4u2/RAagent/agent/config"
+	"io/ioutil"
+	"log"
+)
+
+// ServerTLSConfig returns the TLS configuration used to connect to RAserver.
+// The server certificate is verified against serverCAFile when set, against
+// the system CAs when validateServerTLS is true, and not verified otherwise
+//
+func ServerTLSConfig() *tls.Config {
+	if config.Settings.ServerCAFile == "" {
+		return &tls.Config{InsecureSkipVerify: !config.Settings.ValidateServerTLS}
+	}
+
+	// An unreadable CA file leaves an empty pool, so the server is never trusted
+	pool := x509.NewCertPool()
+	pem, err := ioutil.ReadFile(config.Settings.ServerCAFile)
+	if err == nil && !pool.AppendCertsFromPEM(pem) {
+		log.Println(`No certificate found in`, config.Settings.ServerCAFile)
+	}
+	if err != nil {
+		log.Println(`Cannot read serverCAFile, RAserver cannot be verified :`, err)
+	}
+	return &tls.Config{RootCAs: pool}
+}
@@ -1,11 +1,17 @@
 package config
 
 import (
+	"crypto/ed25519"
+	"crypto/x509"
+	"encoding/base64"
 	"encoding/json"
 	"errors"
+	"io/ioutil"
+	"net"
 	"os"
 	"path/filepath"
 	"regexp"
+	"strconv"
 	"strings"
 )
 
@@ -16,19 +22,93 @@ var Settings config = config{}
 // config type to load and hold configuration settings
 //
 type config struct {
-	ServerIP            []string `json:"serverIP"`
-	ServerURL           string   `json:"serverURL"`
-	ValidateServerTLS   bool     `json:"validateServerTLS"`
-	AgentID             string   `json:"agentID"`
-	AgentBindIP         string   `json:"agentBindIP"`
-	AgentBindPort       string   `json:"agentBindPort"`
-	AllowedIPs          []string `json:"allowedIPs"`
-	RateLimit           int      `json:"rateLimit"`
-	RateLimitBurst      int      `json:"rateLimitBurst"`
-	LogFile             string   `json:"logFile"`
-	LogToFile           bool     `json:"logToFile"`
-	ValidateNotifyTLS   bool     `json:"validateNotifyTLS"`
-	TaskHistoryKeepDays int      `json:"taskHistoryKeepDays"`
+	ServerIP              []string     `json:"serverIP"`
+	ServerURL             string       `json:"serverURL"`
+	ValidateServerTLS     bool         `json:"validateServerTLS"`
+	ServerCAFile          string       `json:"serverCAFile"`
+	AgentID               string       `json:"agentID"`
+	AgentBindIP           string       `json:"agentBindIP"`
+	AgentBindPort         string       `json:"agentBindPort"`
+	AllowedIPs            []string     `json:"allowedIPs"`
+	RateLimit             int          `json:"rateLimit"`
+	RateLimitBurst        int          `json:"rateLimitBurst"`
+	LogFile               string       `json:"logFile"`
+	LogToFile             bool         `json:"logToFile"`
+	ValidateNotifyTLS     bool         `json:"validateNotifyTLS"`
+	TaskHistoryKeepDays   int          `json:"taskHistoryKeepDays"`
+	TaskDefaultTimeout    int          `json:"taskDefaultTimeout"`
+	TaskMaxTimeout        int          `json:"taskMaxTimeout"`
+	TaskCancelGracePeriod int          `json:"taskCancelGracePeriod"`
+	MaxConcurrentTasks    int          `json:"maxConcurrentTasks"`
+	IdempotentModules     []string     `json:"idempotentModules"`
+	TaskStore             string       `json:"taskStore"`
+	HMACKeys              []hmacKey    `json:"hmacKeys"`
+	RequireSignature      []string     `json:"requireSignature"`
+	SignatureMaxAge       int          `json:"signatureMaxAge"`
+	ClientCAFile          string       `json:"clientCAFile"`
+	RequireClientCert     bool         `json:"requireClientCert"`
+	ClientCerts           []ClientCert `json:"clientCerts"`
+	DeniedIPs             []string     `json:"deniedIPs"`
+	TrustedProxies        []string     `json:"trustedProxies"`
+	Policies              []Policy     `json:"policies"`
+	AuditLogFile          string       `json:"auditLogFile"`
+	UpdatePublicKey       string       `json:"updatePublicKey"`
+	UpdateRollbackWindow  int          `json:"updateRollbackWindow"`
+	ProtectedModules      []string     `json:"protectedModules"`
+	PullMode              bool         `json:"pullMode"`
+	PollWait              int          `json:"pollWait"`
+	PollInterval          int          `json:"pollInterval"`
+	PollMaxBackoff        int          `json:"pollMaxBackoff"`
+	HeartbeatInterval     int          `json:"heartbeatInterval"`
+	CertEnrollment        bool         `json:"certEnrollment"`
+	EnrollToken           string       `json:"enrollToken"`
+	EnrollCAFile          string       `json:"enrollCAFile"`
+	CertRenewBefore       int          `json:"certRenewBefore"`
+	MinTLSVersion         string       `json:"minTLSVersion"`
+	CipherSuites          []string     `json:"cipherSuites"`
+	CurvePreferences      []string     `json:"curvePreferences"`
+	DisableHTTP2          bool         `json:"disableHTTP2"`
+	AllowSampleKey        bool         `json:"allowSampleKey"`
+	DrainTimeout          int          `json:"drainTimeout"`
+}
+
+// Policy grants the clients it applies to, identified by IP/CIDR, key ID
+// or client certificate subject, the right to run matching modules.
+// argRegexps holds the Args patterns, compiled when the config is loaded
+//
+type Policy struct {
+	Name         string   `json:"name"`
+	IPs          []string `json:"ips"`
+	KeyIDs       []string `json:"keyIDs"`
+	CertSubjects []string `json:"certSubjects"`
+	Modules      []string `json:"modules"`
+	Modes        []string `json:"modes"`
+	Args         []string `json:"args"`
+	argRegexps   []*regexp.Regexp
+}
+
+// MatchArg checks an argument against the policy pattern at the same position,
+// the whole argument must match
+//
+func (p *Policy) MatchArg(i int, arg string) bool {
+	return i < len(p.argRegexps) && p.argRegexps[i].MatchString(arg)
+}
+
+// ClientCert maps a client certificate subject (common name or SAN) to
+// the endpoint groups and modules it may use
+//
+type ClientCert struct {
+	Subject string   `json:"subject"`
+	Groups  []string `json:"groups"`
+	Modules []string `json:"modules"`
+}
+
+// hmacKey is a shared secret used to sign requests, identified by its ID
+//
+type hmacKey struct {
+	ID     string   `json:"id"`
+	Secret string   `json:"secret"`
+	Groups []string `json:"groups"`
 }
 
 // Version of RAagent
@@ -46,7 +126,24 @@ func (c *config) Load() error {
 	AppBasePath = filepath.Dir(AppBasePath)
 	AppBasePath = strings.TrimSuffix(AppBasePath, `bin`)
 
-	filename := filepath.Join(AppBasePath, "conf", "config.json")
+	confPath := filepath.Join(AppBasePath, "conf")
+	return c.loadFile(filepath.Join(confPath, "config.json"), confPath)
+}
+
+// CheckFile checks that a config file can be loaded, without changing the
+// current settings. Used to validate a config file before it is installed,
+// relative CA file paths are resolved against confPath, the folder it will
+// be installed with
+//
+func CheckFile(filename string, confPath string) error {
+	c := config{}
+	return c.loadFile(filename, confPath)
+}
+
+// Loads and validates configuration settings from provided file. Relative
+// CA file paths are resolved against confPath
+//
+func (c *config) loadFile(filename string, confPath string) error {
 
 	configFile, err := os.Open(filename)
 
@@ -69,9 +166,237 @@ func (c *config) Load() error {
 		return err
 	}
 
+	ipLists := map[string][]string{`serverIP`: c.ServerIP, `allowedIPs`: c.AllowedIPs, `deniedIPs`: c.DeniedIPs, `trustedProxies`: c.TrustedProxies}
+	for name, list := range ipLists {
+		for _, entry := range list {
+			if entry != "" && !isIPOrCIDR(entry) {
+				err = errors.New(`'` + name + `' entry '` + entry + `' is not a valid IP or CIDR range`)
+				return err
+			}
+		}
+	}
+
 	if c.TaskHistoryKeepDays < 1 {
 		c.TaskHistoryKeepDays = 7
 	}
+	if c.TaskDefaultTimeout < 0 {
+		c.TaskDefaultTimeout = 0
+	}
+	if c.TaskMaxTimeout < 0 {
+		c.TaskMaxTimeout = 0
+	}
+	if c.TaskMaxTimeout > 0 && (c.TaskDefaultTimeout == 0 || c.TaskDefaultTimeout > c.TaskMaxTimeout) {
+		c.TaskDefaultTimeout = c.TaskMaxTimeout
+	}
+	if c.DrainTimeout < 1 {
+		c.DrainTimeout = 60
+	}
+	if c.TaskCancelGracePeriod < 1 {
+		c.TaskCancelGracePeriod = 10
+	}
+	if c.MaxConcurrentTasks < 1 {
+		c.MaxConcurrentTasks = 10
+	}
+	if c.TaskStore == "" {
+		c.TaskStore = `file`
+	}
+	if c.TaskStore != `file` && c.TaskStore != `bolt` {
+		err = errors.New(`'taskStore' must be 'file' or 'bolt'`)
+		return err
+	}
+	keyIDs := make(map[string]bool)
+	for i := range c.HMACKeys {
+		key := &c.HMACKeys[i]
+		if key.ID == "" || len(key.Secret) < 16 {
+			err = errors.New(`'hmacKeys' entries must have an 'id' and a 'secret' of at least 16 chars`)
+			return err
+		}
+		if keyIDs[key.ID] {
+			err = errors.New(`'hmacKeys' key ID '` + key.ID + `' is used more than once`)
+			return err
+		}
+		keyIDs[key.ID] = true
+		// Keys may only call the server group when explicitly allowed to
+		if len(key.Groups) == 0 {
+			key.Groups = []string{`tasks`, `modules`}
+		}
+		for _, group := range key.Groups {
+			if group != `tasks` && group != `modules` && group != `server` {
+				err = errors.New(`'hmacKeys' groups must be 'tasks', 'modules' or 'server'`)
+				return err
+			}
+		}
+	}
+	for _, group := range c.RequireSignature {
+		if group != `tasks` && group != `modules` && group != `server` {
+			err = errors.New(`'requireSignature' entries must be 'tasks', 'modules' or 'server'`)
+			return err
+		}
+	}
+	if len(c.RequireSignature) > 0 && len(c.HMACKeys) == 0 {
+		err = errors.New(`'requireSignature' is set but no 'hmacKeys' are configured`)
+		return err
+	}
+	for _, cc := range c.ClientCerts {
+		if cc.Subject == "" {
+			err = errors.New(`'clientCerts' entries must have a 'subject'`)
+			return err
+		}
+		for _, group := range cc.Groups {
+			if group != `tasks` && group != `modules` && group != `server` {
+				err = errors.New(`'clientCerts' groups must be 'tasks', 'modules' or 'server'`)
+				return err
+			}
+		}
+		for _, pattern := range cc.Modules {
+			if _, err = filepath.Match(pattern, ""); err != nil {
+				err = errors.New(`'clientCerts' module pattern '` + pattern + `' is invalid`)
+				return err
+			}
+		}
+	}
+	for i := range c.Policies {
+		p := &c.Policies[i]
+		if p.Name == "" {
+			p.Name = `policy` + strconv.Itoa(i)
+		}
+		for _, entry := range p.IPs {
+			if !isIPOrCIDR(entry) {
+				err = errors.New(`policy '` + p.Name + `' IP '` + entry + `' is not a valid IP or CIDR range`)
+				return err
+			}
+		}
+		for _, pattern := range p.Modules {
+			if _, err = filepath.Match(pattern, ""); err != nil {
+				err = errors.New(`policy '` + p.Name + `' module pattern '` + pattern + `' is invalid`)
+				return err
+			}
+		}
+		for _, mode := range p.Modes {
+			if mode != `attached` && mode != `detached` {
+				err = errors.New(`policy '` + p.Name + `' modes must be 'attached' or 'detached'`)
+				return err
+			}
+		}
+		p.argRegexps = nil
+		for _, arg := range p.Args {
+			argRegexp, err := regexp.Compile(`^(?:` + arg + `)$`)
+			if err != nil {
+				err = errors.New(`policy '` + p.Name + `' argument regex '` + arg + `' is invalid`)
+				return err
+			}
+			p.argRegexps = append(p.argRegexps, argRegexp)
+		}
+	}
+	if c.AgentBindPort == "" && !c.PullMode {
+		err = errors.New(`'agentBindPort' is required unless 'pullMode' is enabled`)
+		return err
+	}
+	if c.ServerCAFile != "" && !filepath.IsAbs(c.ServerCAFile) {
+		c.ServerCAFile = filepath.Join(confPath, c.ServerCAFile)
+	}
+	if c.ServerCAFile != "" {
+		pem, err := ioutil.ReadFile(c.ServerCAFile)
+		if err != nil {
+			return err
+		}
+		if !x509.NewCertPool().AppendCertsFromPEM(pem) {
+			err = errors.New(`no certificate found in 'serverCAFile' ` + c.ServerCAFile)
+			return err
+		}
+	}
+	if c.PullMode && !strings.HasPrefix(c.ServerURL, `https://`) {
+		err = errors.New(`'pullMode' requires an https 'serverURL'`)
+		return err
+	}
+	if c.PullMode && !c.ValidateServerTLS && c.ServerCAFile == "" {
+		err = errors.New(`'pullMode' requires 'validateServerTLS' or a 'serverCAFile' to verify RAserver`)
+		return err
+	}
+	if c.HeartbeatInterval < 0 {
+		c.HeartbeatInterval = 0
+	}
+	if c.HeartbeatInterval > 0 && !strings.HasPrefix(c.ServerURL, `https://`) {
+		err = errors.New(`'heartbeatInterval' requires an https 'serverURL'`)
+		return err
+	}
+	err = c.checkTLS()
+	if err != nil {
+		return err
+	}
+	if c.CertEnrollment && !strings.HasPrefix(c.ServerURL, `https://`) {
+		err = errors.New(`'certEnrollment' requires an https 'serverURL'`)
+		return err
+	}
+	if c.CertEnrollment && !c.ValidateServerTLS && c.ServerCAFile == "" {
+		err = errors.New(`'certEnrollment' requires 'validateServerTLS' or a 'serverCAFile' to verify RAserver`)
+		return err
+	}
+	if c.EnrollCAFile != "" && !filepath.IsAbs(c.EnrollCAFile) {
+		c.EnrollCAFile = filepath.Join(confPath, c.EnrollCAFile)
+	}
+	if c.CertEnrollment && c.EnrollCAFile == "" {
+		err = errors.New(`'certEnrollment' requires an 'enrollCAFile' to verify issued certificates`)
+		return err
+	}
+	if c.EnrollCAFile != "" {
+		pem, err := ioutil.ReadFile(c.EnrollCAFile)
+		if err != nil {
+			return err
+		}
+		if !x509.NewCertPool().AppendCertsFromPEM(pem) {
+			err = errors.New(`no certificate found in 'enrollCAFile' ` + c.EnrollCAFile)
+			return err
+		}
+	}
+	if c.CertRenewBefore < 1 {
+		c.CertRenewBefore = 30
+	}
+	if c.PollWait < 1 {
+		c.PollWait = 30
+	}
+	if c.PollInterval < 1 {
+		c.PollInterval = 5
+	}
+	if c.PollMaxBackoff < 1 {
+		c.PollMaxBackoff = 300
+	}
+	for _, pattern := range c.ProtectedModules {
+		if _, err = filepath.Match(pattern, ""); err != nil {
+			err = errors.New(`'protectedModules' pattern '` + pattern + `' is invalid`)
+			return err
+		}
+	}
+	if c.UpdatePublicKey != "" {
+		key, err := base64.StdEncoding.DecodeString(c.UpdatePublicKey)
+		if err != nil || len(key) != ed25519.PublicKeySize {
+			err = errors.New(`'updatePublicKey' must be a base64 encoded Ed25519 public key`)
+			return err
+		}
+	}
+	if c.RequireClientCert && c.ClientCAFile == "" {
+		err = errors.New(`'requireClientCert' is set but no 'clientCAFile' is configured`)
+		return err
+	}
+	if c.ClientCAFile != "" && !filepath.IsAbs(c.ClientCAFile) {
+		c.ClientCAFile = filepath.Join(confPath, c.ClientCAFile)
+	}
+	if c.ClientCAFile != "" {
+		pem, err := ioutil.ReadFile(c.ClientCAFile)
+		if err != nil {
+			return err
+		}
+		if !x509.NewCertPool().AppendCertsFromPEM(pem) {
+			err = errors.New(`no certificate found in 'clientCAFile' ` + c.ClientCAFile)
+			return err
+		}
+	}
+	if c.UpdateRollbackWindow < 1 {
+		c.UpdateRollbackWindow = 30
+	}
+	if c.SignatureMaxAge < 1 {
+		c.SignatureMaxAge = 300
+	}
 	if c.RateLimit < 1 {
 		c.RateLimit = 1
 	}
@@ -81,3 +406,13 @@ func (c *config) Load() error {
 
 	return err
 }
+
+// Checks if a string is an IP or a CIDR range
+//
+func isIPOrCIDR(entry string) bool {
+	if strings.Contains(entry, `/`) {
+		_, _, err := net.ParseCIDR(entry)
+		return err == nil
+	}
+	return net.ParseIP(entry) != nil
+}
@@ -0,0 +1,82 @@
+package config
+
+import (
+	"crypto/tls"
+	"errors"
+)
+
+// TLS versions accepted in minTLSVersion
+var tlsVersions = map[string]uint16{
+	`1.0`: tls.VersionTLS10,
+	`1.1`: tls.VersionTLS11,
+	`1.2`: tls.VersionTLS12,
+	`1.3`: tls.VersionTLS13,
+}
+
+// Curves accepted in curvePreferences
+var tlsCurves = map[string]tls.CurveID{
+	`X25519`: tls.X25519,
+	`P256`:   tls.CurveP256,
+	`P384`:   tls.CurveP384,
+	`P521`:   tls.CurveP521,
+}
+
+// TLSSettings returns the minimum TLS version, cipher suites and curve
+// preferences of the agent listener. Nil cipher suites and curves mean Go
+// defaults
+//
+func (c *config) TLSSettings() (minVersion uint16, cipherSuites []uint16, curves []tls.CurveID) {
+	minVersion = tlsVersions[c.MinTLSVersion]
+	for _, name := range c.CipherSuites {
+		for _, suite := range tls.CipherSuites() {
+			if suite.Name == name {
+				cipherSuites = append(cipherSuites, suite.ID)
+			}
+		}
+	}
+	for _, name := range c.CurvePreferences {
+		curves = append(curves, tlsCurves[name])
+	}
+	return minVersion, cipherSuites, curves
+}
+
+// Validates TLS settings. Only cipher suites Go considers secure are
+// accepted, TLS 1.3 suites cannot be configured
+//
+func (c *config) checkTLS() error {
+	if c.MinTLSVersion == "" {
+		c.MinTLSVersion = `1.2`
+	}
+	if _, found := tlsVersions[c.MinTLSVersion]; !found {
+		return errors.New(`'minTLSVersion' must be '1.0', '1.1', '1.2' or '1.3'`)
+	}
+
+	for _, name := range c.CipherSuites {
+		for _, suite := range tls.InsecureCipherSuites() {
+			if suite.Name == name {
+				return errors.New(`'cipherSuites' entry '` + name + `' is insecure`)
+			}
+		}
+		supported := false
+		for _, suite := range tls.CipherSuites() {
+			if suite.Name != name {
+				continue
+			}
+			for _, version := range suite.SupportedVersions {
+				if version != tls.VersionTLS13 {
+					supported = true
+				}
+			}
+		}
+		if !supported {
+			return errors.New(`'cipherSuites' entry '` + name + `' is not a configurable TLS 1.0-1.2 cipher suite`)
+		}
+	}
+
+	for _, name := range c.CurvePreferences {
+		if _, found := tlsCurves[name]; !found {
+			return errors.New(`'curvePreferences' entry '` + name + `' must be 'X25519', 'P256', 'P384' or 'P521'`)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,394 @@
+package enroll
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"github.com/miky4u2/RAagent/agent/common"
+	"github.com/miky4u2/RAagent/agent/config"
+	"github.com/miky4u2/RAagent/agent/lifecycle"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+)
+
+// RAserver endpoints used to enroll the agent and renew its certificate
+const (
+	enrollPath = `/api/agents/enroll`
+	renewPath  = `/api/agents/renew`
+)
+
+// Delays between two attempts to get a certificate after an error
+const (
+	minBackoff = 30 * time.Second
+	maxBackoff = time.Hour
+)
+
+// Longest sleep before the certificate expiry is checked again
+const maxCheckInterval = 24 * time.Hour
+
+// Maximum size of the server response
+const maxResponseSize = 1024 * 1024
+
+// certReq is the content of enrollment and renewal requests. The one-time
+// token is only sent to enroll, renewals are authenticated with the
+// current certificate
+//
+type certReq struct {
+	AgentID string `json:"agentID"`
+	Token   string `json:"token,omitempty"`
+	CSR     string `json:"csr"`
+}
+
+// certRes is the server response, a PEM certificate optionally followed by
+// its chain
+//
+type certRes struct {
+	Certificate string `json:"certificate"`
+}
+
+// Start enrolls the agent with RAserver and keeps its certificate renewed,
+// when certEnrollment is enabled. Start is called before a self-signed
+// certificate is generated: if no certificate is installed yet and an
+// enrollToken is configured, it waits for the enrollment to succeed.
+// Otherwise a self-signed certificate is replaced and an enrolled one
+// renewed in the background.
+// installed is called each time a new certificate has been written
+//
+func Start(installed func()) error {
+	if !config.Settings.CertEnrollment {
+		return nil
+	}
+
+	cert, err := current()
+	if err != nil {
+		log.Println(`Cannot read current certificate :`, err)
+	}
+
+	// Nothing to serve yet, enroll before the listener starts
+	if cert == nil && err == nil && config.Settings.EnrollToken != "" {
+		backoff := minBackoff
+		for {
+			err = request(enrollPath, nil)
+			if err == nil {
+				break
+			}
+			log.Println(`Enrollment with RAserver failed, retrying in`, backoff, `:`, err)
+			select {
+			case <-time.After(backoff):
+			case <-lifecycle.Stopping():
+				return errors.New(`agent stopped before it could enroll`)
+			}
+			backoff = nextBackoff(backoff)
+		}
+		log.Println(`Enrolled with RAserver, certificate installed`)
+	}
+
+	go maintain(installed)
+	return nil
+}
+
+// Enrolls the agent while it uses a self-signed certificate, then renews
+// the certificate before it expires
+//
+func maintain(installed func()) {
+	backoff := minBackoff
+	for {
+		cert, err := current()
+		if err != nil {
+			log.Println(`Cannot read current certificate :`, err)
+		}
+
+		action := `Renewal`
+		if cert == nil || selfSigned(cert) {
+			if config.Settings.EnrollToken == "" {
+				log.Println(`Certificate is not enrolled and no 'enrollToken' is configured, enrollment disabled`)
+				return
+			}
+			action = `Enrollment`
+			err = request(enrollPath, nil)
+		} else {
+			wait := time.Until(renewAt(cert))
+			if wait > 0 {
+				if wait > maxCheckInterval {
+					wait = maxCheckInterval
+				}
+				time.Sleep(wait)
+				continue
+			}
+			var keyPair tls.Certificate
+			keyPair, err = tls.LoadX509KeyPair(certPath(), keyPath())
+			if err == nil {
+				err = request(renewPath, &keyPair)
+			}
+		}
+
+		if err != nil {
+			log.Println(action, `of agent certificate failed, retrying in`, backoff, `:`, err)
+			time.Sleep(backoff)
+			backoff = nextBackoff(backoff)
+			continue
+		}
+
+		log.Println(action, `of agent certificate done, new certificate installed`)
+		backoff = minBackoff
+		if installed != nil {
+			installed()
+		}
+	}
+}
+
+// Generates a new key and CSR, submits the CSR to RAserver and installs
+// the returned certificate. Renewal requests present clientCert
+//
+func request(path string, clientCert *tls.Certificate) error {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+	csr, err := newCSR(key)
+	if err != nil {
+		return err
+	}
+
+	body := certReq{AgentID: config.Settings.AgentID, CSR: string(csr)}
+	if clientCert == nil {
+		body.Token = config.Settings.EnrollToken
+	}
+	content, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+
+	tlsConfig := common.ServerTLSConfig()
+	if clientCert != nil {
+		tlsConfig.Certificates = []tls.Certificate{*clientCert}
+	}
+	client := &http.Client{
+		Timeout:   30 * time.Second,
+		Transport: &http.Transport{TLSClientConfig: tlsConfig},
+	}
+
+	res, err := client.Post(config.Settings.ServerURL+path, "application/json", bytes.NewReader(content))
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return errors.New(`received status code ` + strconv.Itoa(res.StatusCode))
+	}
+
+	response := certRes{}
+	err = json.NewDecoder(io.LimitReader(res.Body, maxResponseSize)).Decode(&response)
+	if err != nil {
+		return err
+	}
+
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return err
+	}
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: `EC PRIVATE KEY`, Bytes: keyDER})
+
+	return install([]byte(response.Certificate), keyPEM)
+}
+
+// Creates a PEM certificate request for the agent, with the agent ID as
+// common name and the agent ID, hostname and bind IP as SANs
+//
+func newCSR(key *ecdsa.PrivateKey) ([]byte, error) {
+	template := &x509.CertificateRequest{
+		Subject:  pkix.Name{CommonName: config.Settings.AgentID},
+		DNSNames: []string{config.Settings.AgentID},
+	}
+	hostname, err := os.Hostname()
+	if err == nil && hostname != config.Settings.AgentID {
+		template.DNSNames = append(template.DNSNames, hostname)
+	}
+	if ip := net.ParseIP(config.Settings.AgentBindIP); ip != nil && !ip.IsUnspecified() {
+		template.IPAddresses = append(template.IPAddresses, ip)
+	}
+
+	der, err := x509.CreateCertificateRequest(rand.Reader, template, key)
+	if err != nil {
+		return nil, err
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: `CERTIFICATE REQUEST`, Bytes: der}), nil
+}
+
+// Checks that the received certificate matches the new key, is issued
+// for the agent and chains to enrollCAFile, then replaces conf/cert.pem
+// and conf/key.pem
+//
+func install(certPEM, keyPEM []byte) error {
+	keyPair, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		return errors.New(`received certificate does not match the request : ` + err.Error())
+	}
+	err = verify(keyPair.Certificate)
+	if err != nil {
+		return errors.New(`received certificate cannot be verified : ` + err.Error())
+	}
+
+	// Write both files aside first, so a failure leaves the current pair in
+	// place. The key is renamed first, an install interrupted before the
+	// certificate is renamed is completed by RecoverInstall
+	err = ioutil.WriteFile(keyPath()+`.new`, keyPEM, 0600)
+	if err != nil {
+		return err
+	}
+	err = ioutil.WriteFile(certPath()+`.new`, certPEM, 0644)
+	if err != nil {
+		os.Remove(keyPath() + `.new`)
+		return err
+	}
+	err = os.Rename(keyPath()+`.new`, keyPath())
+	if err != nil {
+		return err
+	}
+	return os.Rename(certPath()+`.new`, certPath())
+}
+
+// Verifies a received certificate chain: the leaf must be issued for the
+// agent ID, usable as a server certificate and chain to a CA of
+// enrollCAFile, through the intermediates sent along
+//
+func verify(chain [][]byte) error {
+	leaf, err := x509.ParseCertificate(chain[0])
+	if err != nil {
+		return err
+	}
+	if leaf.Subject.CommonName != config.Settings.AgentID {
+		return errors.New(`common name '` + leaf.Subject.CommonName + `' is not the agent ID`)
+	}
+
+	roots := x509.NewCertPool()
+	rootsPEM, err := ioutil.ReadFile(config.Settings.EnrollCAFile)
+	if err != nil {
+		return err
+	}
+	if !roots.AppendCertsFromPEM(rootsPEM) {
+		return errors.New(`no certificate found in ` + config.Settings.EnrollCAFile)
+	}
+	intermediates := x509.NewCertPool()
+	for _, der := range chain[1:] {
+		cert, err := x509.ParseCertificate(der)
+		if err != nil {
+			return err
+		}
+		intermediates.AddCert(cert)
+	}
+
+	_, err = leaf.Verify(x509.VerifyOptions{
+		Roots:         roots,
+		Intermediates: intermediates,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	})
+	return err
+}
+
+// RecoverInstall completes or undoes a certificate install interrupted by a
+// crash, so that conf/cert.pem and conf/key.pem always form a pair. Leftover
+// .new files are removed
+//
+func RecoverInstall() {
+	certNew, keyNew := certPath()+`.new`, keyPath()+`.new`
+	if !common.FileExists(certNew) {
+		os.Remove(keyNew)
+		return
+	}
+
+	// Interrupted before the key was renamed, the current pair is intact
+	if common.FileExists(keyNew) {
+		os.Remove(keyNew)
+		os.Remove(certNew)
+		return
+	}
+
+	// Interrupted between the two renames, key.pem already is the new key
+	_, err := tls.LoadX509KeyPair(certNew, keyPath())
+	if err != nil {
+		log.Println(`Cannot complete interrupted certificate install :`, err)
+		os.Remove(certNew)
+		return
+	}
+	err = os.Rename(certNew, certPath())
+	if err != nil {
+		log.Println(`Cannot complete interrupted certificate install :`, err)
+		return
+	}
+	log.Println(`Completed interrupted certificate install`)
+}
+
+// InstallPending reports whether a certificate install is in progress, the
+// certificate and key files may then not match yet
+//
+func InstallPending() bool {
+	return common.FileExists(certPath()+`.new`) || common.FileExists(keyPath()+`.new`)
+}
+
+// Returns the currently installed certificate, or nil if there is none
+//
+func current() (*x509.Certificate, error) {
+	certPEM, err := ioutil.ReadFile(certPath())
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(certPEM)
+	if block == nil || block.Type != `CERTIFICATE` {
+		return nil, errors.New(`no certificate found in ` + certPath())
+	}
+	return x509.ParseCertificate(block.Bytes)
+}
+
+// Reports whether a certificate is self-signed, and so was not issued by
+// RAserver
+//
+func selfSigned(cert *x509.Certificate) bool {
+	return bytes.Equal(cert.RawIssuer, cert.RawSubject) &&
+		cert.CheckSignature(cert.SignatureAlgorithm, cert.RawTBSCertificate, cert.Signature) == nil
+}
+
+// Works out when a certificate should be renewed: certRenewBefore days
+// before it expires, or after two thirds of its lifetime for short lived
+// certificates
+//
+func renewAt(cert *x509.Certificate) time.Time {
+	before := time.Duration(config.Settings.CertRenewBefore) * 24 * time.Hour
+	if lifetime := cert.NotAfter.Sub(cert.NotBefore); before > lifetime/3 {
+		before = lifetime / 3
+	}
+	return cert.NotAfter.Add(-before)
+}
+
+func nextBackoff(backoff time.Duration) time.Duration {
+	backoff *= 2
+	if backoff > maxBackoff {
+		backoff = maxBackoff
+	}
+	return backoff
+}
+
+func certPath() string {
+	return filepath.Join(config.AppBasePath, `conf`, `cert.pem`)
+}
+
+func keyPath() string {
+	return filepath.Join(config.AppBasePath, `conf`, `key.pem`)
+}
@@ -0,0 +1,165 @@
+package heartbeat
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"github.com/miky4u2/RAagent/agent/common"
+	"github.com/miky4u2/RAagent/agent/config"
+	"github.com/miky4u2/RAagent/agent/module"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"time"
+)
+
+// RAserver endpoints used to register the agent and send heartbeats
+const (
+	registerPath  = `/api/agents/register`
+	heartbeatPath = `/api/agents/heartbeat`
+)
+
+// Maximum delay between two attempts to reach the server after an error
+const maxBackoff = 10 * time.Minute
+
+// agentState is the content of registration and heartbeat requests
+//
+type agentState struct {
+	AgentID      string        `json:"agentID"`
+	Version      string        `json:"version"`
+	OS           string        `json:"os"`
+	Arch         string        `json:"arch"`
+	Hostname     string        `json:"hostname"`
+	PullMode     bool          `json:"pullMode"`
+	StartTime    string        `json:"startTime"`
+	Uptime       int64         `json:"uptime"`
+	RunningTasks int           `json:"runningTasks"`
+	QueuedTasks  int           `json:"queuedTasks"`
+	Modules      []moduleEntry `json:"modules"`
+}
+
+// Module of the inventory sent to the server
+type moduleEntry struct {
+	Name    string `json:"name"`
+	SHA256  string `json:"sha256"`
+	Version string `json:"version"`
+}
+
+// Counters is a function returning the number of running and queued tasks
+type Counters func() (running int, queued int)
+
+// Agent start time, used to work out uptime
+var startTime = time.Now()
+
+// Start registers the agent with RAserver and sends heartbeats every
+// heartbeatInterval seconds, when heartbeats are enabled. Registration is
+// retried, with an increasing delay, until the server answers, and sent
+// again after the server could not be reached
+//
+func Start(counters Counters) {
+	if config.Settings.HeartbeatInterval == 0 {
+		return
+	}
+
+	client := &http.Client{
+		Timeout: 30 * time.Second,
+		Transport: &http.Transport{
+			TLSClientConfig: common.ServerTLSConfig(),
+		},
+	}
+
+	go func() {
+		interval := time.Duration(config.Settings.HeartbeatInterval) * time.Second
+		backoff := interval
+		registered := false
+		for {
+			path := heartbeatPath
+			if !registered {
+				path = registerPath
+			}
+
+			err := send(client, path, state(counters))
+			if err != nil {
+				if registered {
+					log.Println(`Heartbeat to RAserver failed, registering again in`, backoff, `:`, err)
+				} else {
+					log.Println(`Registration with RAserver failed, retrying in`, backoff, `:`, err)
+				}
+				registered = false
+				time.Sleep(backoff)
+				backoff *= 2
+				if backoff > maxBackoff {
+					backoff = maxBackoff
+				}
+				continue
+			}
+
+			if !registered {
+				log.Println(`Registered with RAserver`)
+				registered = true
+			}
+			backoff = interval
+			time.Sleep(interval)
+		}
+	}()
+}
+
+// Collects the current agent state
+//
+func state(counters Counters) agentState {
+	hostname, _ := os.Hostname()
+	s := agentState{
+		AgentID:   config.Settings.AgentID,
+		Version:   config.Version,
+		OS:        runtime.GOOS,
+		Arch:      runtime.GOARCH,
+		Hostname:  hostname,
+		PullMode:  config.Settings.PullMode,
+		StartTime: startTime.Format("2006-01-02 15:04:05"),
+		Uptime:    int64(time.Since(startTime).Seconds()),
+		Modules:   []moduleEntry{},
+	}
+	s.RunningTasks, s.QueuedTasks = counters()
+
+	modules, err := module.List(filepath.Join(config.AppBasePath, `modules`))
+	if err != nil {
+		log.Println(`Error listing modules for heartbeat :`, err)
+	}
+	for _, m := range modules {
+		entry := moduleEntry{Name: m.Name, SHA256: m.SHA256}
+		if m.Manifest != nil {
+			entry.Version = m.Manifest.Version
+		}
+		s.Modules = append(s.Modules, entry)
+	}
+	return s
+}
+
+// Posts the agent state to a RAserver endpoint
+//
+func send(client *http.Client, path string, s agentState) error {
+	content, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest("POST", config.Settings.ServerURL+path, bytes.NewReader(content))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	res, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return errors.New(`received status code ` + strconv.Itoa(res.StatusCode))
+	}
+	return nil
+}
@@ -0,0 +1,85 @@
+package lifecycle
+
+import (
+	"github.com/miky4u2/RAagent/agent/config"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"strconv"
+	"sync"
+	"syscall"
+)
+
+// state of the agent, stop is closed once the agent is asked to stop and
+// force once it is asked not to wait for running tasks
+//
+var state = struct {
+	sync.Mutex
+	draining bool
+	forced   bool
+	stop     chan struct{}
+	force    chan struct{}
+}{stop: make(chan struct{}), force: make(chan struct{})}
+
+// Stop asks the agent to drain and stop: new tasks are refused and running
+// tasks are waited for, up to drainTimeout, unless force is set.
+// May be called again to force a stop already in progress
+//
+func Stop(force bool) {
+	state.Lock()
+	defer state.Unlock()
+	if !state.draining {
+		state.draining = true
+		close(state.stop)
+	}
+	if force && !state.forced {
+		state.forced = true
+		close(state.force)
+	}
+}
+
+// Draining reports whether the agent has been asked to stop
+//
+func Draining() bool {
+	state.Lock()
+	defer state.Unlock()
+	return state.draining
+}
+
+// Stopping returns a channel closed when the agent is asked to stop
+//
+func Stopping() <-chan struct{} {
+	return state.stop
+}
+
+// Forced returns a channel closed when the agent is asked to stop without
+// waiting for running tasks
+//
+func Forced() <-chan struct{} {
+	return state.force
+}
+
+// Refuse answers a request the agent cannot take while draining with a 503
+// status, asking the client to retry once the agent is back
+//
+func Refuse(w http.ResponseWriter) {
+	w.Header().Set("Retry-After", strconv.Itoa(config.Settings.DrainTimeout))
+	http.Error(w, http.StatusText(http.StatusServiceUnavailable), http.StatusServiceUnavailable)
+}
+
+// HandleSignals drains and stops the agent on SIGTERM or interrupt, and
+// forces the stop on a second signal
+//
+func HandleSignals() {
+	signals := make(chan os.Signal, 2)
+	signal.Notify(signals, syscall.SIGTERM, os.Interrupt)
+	go func() {
+		sig := <-signals
+		log.Println(`Received`, sig, `signal, stopping`)
+		Stop(false)
+		sig = <-signals
+		log.Println(`Received`, sig, `signal again, forcing stop`)
+		Stop(true)
+	}()
+}
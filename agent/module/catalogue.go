@@ -0,0 +1,158 @@
+package module
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"strings"
+)
+
+// Info describes an installed module
+//
+type Info struct {
+	Name          string    `json:"name"`
+	Size          int64     `json:"size"`
+	ModTime       string    `json:"mtime"`
+	SHA256        string    `json:"sha256"`
+	Executable    bool      `json:"executable"`
+	CmdTarget     *Cmd      `json:"cmdTarget"`
+	Manifest      *Manifest `json:"manifest"`
+	ManifestError string    `json:"manifestError"`
+}
+
+// Cmd is the content of a .cmd special module
+//
+type Cmd struct {
+	Cmd  string   `json:"cmd"`
+	Args []string `json:"args"`
+}
+
+// Error returned by GetInfo for unknown modules
+var ErrNotFound = errors.New(`module does not exist`)
+
+// NameRegex matches valid module names
+var NameRegex = regexp.MustCompile(`^[a-zA-Z0-9]+[a-zA-Z0-9\.\-_]*$`)
+
+// ReadCmd parses a .cmd special module. The returned Cmd is never nil
+//
+func ReadCmd(path string) (*Cmd, error) {
+	cmd := &Cmd{}
+	cmdFile, err := os.Open(path)
+	if err != nil {
+		return cmd, err
+	}
+	defer cmdFile.Close()
+
+	err = json.NewDecoder(cmdFile).Decode(cmd)
+	return cmd, err
+}
+
+// List returns the description of every module installed in modulesPath
+//
+func List(modulesPath string) ([]Info, error) {
+	modules := []Info{}
+
+	files, err := ioutil.ReadDir(modulesPath)
+	if err != nil {
+		return modules, err
+	}
+	for _, f := range files {
+		if !f.Mode().IsRegular() || IsManifest(f.Name()) || !NameRegex.MatchString(f.Name()) {
+			continue
+		}
+		info, err := describe(modulesPath, f)
+		if err != nil {
+			return modules, err
+		}
+		modules = append(modules, info)
+	}
+	return modules, nil
+}
+
+// GetInfo returns the description of a module
+//
+func GetInfo(modulesPath string, name string) (Info, error) {
+	if !NameRegex.MatchString(name) || IsManifest(name) {
+		return Info{}, ErrNotFound
+	}
+	f, err := os.Stat(filepath.Join(modulesPath, name))
+	if os.IsNotExist(err) || (err == nil && !f.Mode().IsRegular()) {
+		return Info{}, ErrNotFound
+	}
+	if err != nil {
+		return Info{}, err
+	}
+	return describe(modulesPath, f)
+}
+
+// Builds the description of a module file
+//
+func describe(modulesPath string, f os.FileInfo) (Info, error) {
+	path := filepath.Join(modulesPath, f.Name())
+	info := Info{
+		Name:       f.Name(),
+		Size:       f.Size(),
+		ModTime:    f.ModTime().Format("2006-01-02 15:04:05"),
+		Executable: isExecutable(f),
+	}
+
+	var err error
+	info.SHA256, err = FileSHA256(path)
+	if err != nil {
+		return info, err
+	}
+
+	if strings.HasSuffix(f.Name(), `.cmd`) {
+		info.CmdTarget, err = ReadCmd(path)
+		if err != nil {
+			info.CmdTarget = nil
+		}
+	}
+
+	info.Manifest, err = LoadManifest(modulesPath, f.Name())
+	if err != nil {
+		info.ManifestError = err.Error()
+	}
+
+	return info, nil
+}
+
+// FileSHA256 returns the hex encoded SHA-256 of a file
+//
+func FileSHA256(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// Checks if a module can be executed. .cmd special modules are never executed
+// themselves, on Windows this depends on the extension
+//
+func isExecutable(f os.FileInfo) bool {
+	if strings.HasSuffix(f.Name(), `.cmd`) {
+		return true
+	}
+	if runtime.GOOS == `windows` {
+		switch strings.ToLower(filepath.Ext(f.Name())) {
+		case `.exe`, `.bat`, `.cmd`, `.com`:
+			return true
+		}
+		return false
+	}
+	return f.Mode()&0111 != 0
+}
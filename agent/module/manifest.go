@@ -0,0 +1,159 @@
+package module
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/miky4u2/RAagent/agent/common"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Manifest describes a module. It is read from an optional sidecar json
+// file named after the module, e.g. modules/restart_services.json
+//
+type Manifest struct {
+	Description string `json:"description"`
+	Version     string `json:"version"`
+	Args        []Arg  `json:"args"`
+	DefaultMode string `json:"defaultMode"`
+	Timeout     int    `json:"timeout"`
+	Idempotent  bool   `json:"idempotent"`
+}
+
+// Arg describes a positional module argument
+//
+type Arg struct {
+	Name        string   `json:"name"`
+	Description string   `json:"description"`
+	Type        string   `json:"type"`
+	Regex       string   `json:"regex"`
+	Enum        []string `json:"enum"`
+	Base64      bool     `json:"base64"`
+	Required    bool     `json:"required"`
+	regex       *regexp.Regexp
+}
+
+// Extension of module manifest files
+const ManifestExt = `.json`
+
+// IsManifest checks if a file of the modules folder is a manifest rather than a module
+//
+func IsManifest(name string) bool {
+	return strings.HasSuffix(name, ManifestExt)
+}
+
+// LoadManifest reads and checks the manifest of a module.
+// Returns nil without error if the module has no manifest
+//
+func LoadManifest(modulesPath string, name string) (*Manifest, error) {
+	manifestFile, err := os.Open(filepath.Join(modulesPath, name+ManifestExt))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer manifestFile.Close()
+
+	m := &Manifest{}
+	err = json.NewDecoder(manifestFile).Decode(m)
+	if err != nil {
+		return nil, err
+	}
+
+	// Check the manifest itself
+	if m.DefaultMode != "" && m.DefaultMode != "attached" && m.DefaultMode != "detached" {
+		return nil, errors.New(`'defaultMode' must be 'attached' or 'detached'`)
+	}
+	if m.Timeout < 0 {
+		return nil, errors.New(`'timeout' must be 0 or more`)
+	}
+	for i := range m.Args {
+		a := &m.Args[i]
+		if a.Name == "" {
+			a.Name = `arg` + strconv.Itoa(i)
+		}
+		if a.Type == "" {
+			a.Type = `string`
+		}
+		if a.Type != `string` && a.Type != `int` && a.Type != `number` && a.Type != `bool` {
+			return nil, fmt.Errorf(`argument '%s' has unknown type '%s', must be string, int, number or bool`, a.Name, a.Type)
+		}
+		if a.Regex != "" {
+			a.regex, err = regexp.Compile(`^(?:` + a.Regex + `)$`)
+			if err != nil {
+				return nil, fmt.Errorf(`argument '%s' has an invalid regex: %v`, a.Name, err)
+			}
+		}
+		if a.Required && i > 0 && !m.Args[i-1].Required {
+			return nil, fmt.Errorf(`argument '%s' is required but follows an optional argument`, a.Name)
+		}
+	}
+
+	return m, nil
+}
+
+// ValidateArgs checks task arguments against the manifest.
+// Returns one error message per invalid field
+//
+func (m *Manifest) ValidateArgs(args []string) []string {
+	var errMsgs []string
+
+	if len(args) > len(m.Args) {
+		errMsgs = append(errMsgs, fmt.Sprintf(`'args' too many arguments, module accepts at most %d`, len(m.Args)))
+	}
+
+	for i, a := range m.Args {
+		field := fmt.Sprintf(`'args[%d]' (%s)`, i, a.Name)
+
+		if i >= len(args) {
+			if a.Required {
+				errMsgs = append(errMsgs, field+` is required`)
+			}
+			continue
+		}
+
+		value := args[i]
+		if a.Base64 {
+			decoded, err := base64.StdEncoding.DecodeString(value)
+			if err != nil {
+				errMsgs = append(errMsgs, field+` must be base64 encoded`)
+				continue
+			}
+			value = string(decoded)
+		}
+
+		switch a.Type {
+		case `int`:
+			if _, err := strconv.ParseInt(value, 10, 64); err != nil {
+				errMsgs = append(errMsgs, field+` must be an integer`)
+				continue
+			}
+		case `number`:
+			if _, err := strconv.ParseFloat(value, 64); err != nil {
+				errMsgs = append(errMsgs, field+` must be a number`)
+				continue
+			}
+		case `bool`:
+			if value != `true` && value != `false` {
+				errMsgs = append(errMsgs, field+` must be true or false`)
+				continue
+			}
+		}
+
+		if len(a.Enum) > 0 && !common.Find(a.Enum, value) {
+			errMsgs = append(errMsgs, field+` must be one of: `+strings.Join(a.Enum, `, `))
+			continue
+		}
+		if a.regex != nil && !a.regex.MatchString(value) {
+			errMsgs = append(errMsgs, field+` must match `+a.Regex)
+		}
+	}
+
+	return errMsgs
+}
@@ -0,0 +1,114 @@
+package webserver
+
+import (
+	"crypto/tls"
+	"github.com/miky4u2/RAagent/agent/config"
+	"github.com/miky4u2/RAagent/agent/enroll"
+	"log"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Interval between two checks of the certificate files for changes
+const certCheckInterval = 10 * time.Second
+
+// Certificate served by the listener, replaced without a restart when the
+// certificate files change. stamp identifies the files last loaded
+//
+var certificate = struct {
+	sync.RWMutex
+	keyPair *tls.Certificate
+	stamp   string
+}{}
+
+// Loads conf/cert.pem and conf/key.pem, new TLS connections use them
+// from then on. If the pair cannot be loaded, the current certificate is kept
+//
+func loadCertificate() error {
+	stamp := certificateStamp()
+
+	keyPair, err := tls.LoadX509KeyPair(certificatePaths())
+	if err == nil {
+		err = checkSampleKey(&keyPair)
+	}
+
+	certificate.Lock()
+	defer certificate.Unlock()
+	certificate.stamp = stamp
+	if err != nil {
+		return err
+	}
+	certificate.keyPair = &keyPair
+	log.Println(`Serving TLS certificate with SHA-256 fingerprint`, fingerprint(&keyPair))
+	return nil
+}
+
+// Reloads the certificate, logging the outcome
+//
+func reloadCertificate(reason string) {
+	err := loadCertificate()
+	if err != nil {
+		log.Println(`Cannot reload TLS certificate (`+reason+`), keeping current one :`, err)
+		return
+	}
+	log.Println(`Reloaded TLS certificate (` + reason + `)`)
+}
+
+// Reloads the certificate when its files change, or when the agent
+// receives SIGHUP. File changes are ignored while a new certificate is
+// being installed
+//
+func watchCertificate() {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	ticker := time.NewTicker(certCheckInterval)
+
+	for {
+		select {
+		case <-hup:
+			reloadCertificate(`SIGHUP received`)
+		case <-ticker.C:
+			certificate.RLock()
+			stamp := certificate.stamp
+			certificate.RUnlock()
+			if certificateStamp() != stamp && !enroll.InstallPending() {
+				reloadCertificate(`certificate files changed`)
+			}
+		}
+	}
+}
+
+// tls.Config GetCertificate callback returning the current certificate
+//
+func getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	certificate.RLock()
+	defer certificate.RUnlock()
+	return certificate.keyPair, nil
+}
+
+// Returns the certificate and key file paths
+//
+func certificatePaths() (string, string) {
+	return filepath.Join(config.AppBasePath, "conf", "cert.pem"), filepath.Join(config.AppBasePath, "conf", "key.pem")
+}
+
+// Returns a string which changes whenever the certificate or key file is
+// modified
+//
+func certificateStamp() string {
+	stamp := ""
+	cert, key := certificatePaths()
+	for _, path := range []string{cert, key} {
+		fs, err := os.Stat(path)
+		if err == nil {
+			stamp += strconv.FormatInt(fs.ModTime().UnixNano(), 10) + `/` + strconv.FormatInt(fs.Size(), 10)
+		}
+		stamp += `;`
+	}
+	return stamp
+}
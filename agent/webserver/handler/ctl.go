@@ -3,27 +3,32 @@ package handler
 import (
 	"encoding/base64"
 	"encoding/json"
-	"github.com/miky4u2/RAagent/agent/common"
+	"github.com/miky4u2/RAagent/agent/audit"
+	"github.com/miky4u2/RAagent/agent/auth"
 	"github.com/miky4u2/RAagent/agent/config"
+	"github.com/miky4u2/RAagent/agent/lifecycle"
 	"io/ioutil"
 	"log"
 	"net/http"
 	"os"
 	"path/filepath"
-	"time"
 )
 
 // Ctl HTTP handler function
 //
 func Ctl(w http.ResponseWriter, req *http.Request) {
 
-	// Check if IP is allowed, abort if not. (Must be server IP)
-	if !common.IsIPAllowed(req, config.Settings.ServerIP) {
+	// Check if the request is authorized, abort if not. (Must be the server)
+	id, ok := auth.Authorize(req, auth.GroupServer)
+	rec := audit.Record{Event: `ctl`, Client: id.String(), IP: id.IP, Result: `unauthorized`}
+	defer func() { audit.Log(rec) }()
+	if !ok {
 		http.Error(w, http.StatusText(403), http.StatusForbidden)
 		return
 	}
 
 	// POST method only
+	rec.Result = `invalid method`
 	if req.Method != "POST" {
 		http.Error(w, http.StatusText(403), http.StatusForbidden)
 		return
@@ -35,7 +40,8 @@ func Ctl(w http.ResponseWriter, req *http.Request) {
 
 	// Instantiate a ctlReq and ctlRes struct to be populated
 	ctlReq := struct {
-		Type string `json:"type"`
+		Type  string `json:"type"`
+		Force bool   `json:"force"`
 	}{}
 
 	ctlRes := struct {
@@ -46,6 +52,8 @@ func Ctl(w http.ResponseWriter, req *http.Request) {
 
 	// Populate the ctlReq struct with received json request
 	json.NewDecoder(req.Body).Decode(&ctlReq)
+	rec.Type = ctlReq.Type
+	rec.Result = `failed`
 
 	// If control Type is invalid, abbort now, respond with error
 	if ctlReq.Type != `status` && ctlReq.Type != `restart` && ctlReq.Type != `stop` {
@@ -63,6 +71,7 @@ func Ctl(w http.ResponseWriter, req *http.Request) {
 
 	// If we get here, the received control Type is valid
 	ctlRes.Status = `done`
+	rec.Result = `done`
 	var output string
 
 	// If control Type is status
@@ -77,22 +86,31 @@ func Ctl(w http.ResponseWriter, req *http.Request) {
 			output += `[` + f.Name() + `]`
 		}
 		output += "\n"
+		if lifecycle.Draining() {
+			output += "Draining, waiting for running tasks to end before stopping\n"
+		}
+	}
+
+	// When stopping, running tasks are waited for unless force is set
+	when := `once running tasks end...`
+	if ctlReq.Force {
+		when = `now...`
 	}
 
 	// If control Type is restart
 	if ctlReq.Type == `restart` {
-		output = `Version ` + config.Version + ` restarting now...` + "\n"
+		output = `Version ` + config.Version + ` restarting ` + when + "\n"
 		emptyFile, _ := os.Create(filepath.Join(config.AppBasePath, `bin`, `agent_restart`))
 		emptyFile.Close()
 		log.Println(`Received Ctl Restart, RAagent will now attempt to restart...`)
-		go func() { time.Sleep(2 * time.Second); os.Exit(0) }()
+		lifecycle.Stop(ctlReq.Force)
 	}
 
 	// If control Type is stop
 	if ctlReq.Type == `stop` {
-		output = `Version ` + config.Version + ` shutting down now...` + "\n"
+		output = `Version ` + config.Version + ` shutting down ` + when + "\n"
 		log.Println(`Received Ctl Stop, RAagent will now shutting down...`)
-		go func() { time.Sleep(2 * time.Second); os.Exit(0) }()
+		lifecycle.Stop(ctlReq.Force)
 	}
 
 	// Encode output and send response
@@ -0,0 +1,69 @@
+package modules
+
+import (
+	"encoding/json"
+	"github.com/miky4u2/RAagent/agent/auth"
+	"github.com/miky4u2/RAagent/agent/config"
+	"github.com/miky4u2/RAagent/agent/module"
+	"log"
+	"net/http"
+	"path/filepath"
+)
+
+type infoReq struct {
+	Name string `json:"name"`
+}
+
+type infoRes struct {
+	Status    string       `json:"status"`
+	ErrorMsgs []string     `json:"errorMsgs"`
+	Module    *module.Info `json:"module"`
+}
+
+// Info HTTP handler function
+//
+func Info(w http.ResponseWriter, req *http.Request) {
+
+	// Check if the request is authorized, abort if not
+	_, ok := auth.Authorize(req, auth.GroupModules)
+	if !ok {
+		http.Error(w, http.StatusText(403), http.StatusForbidden)
+		return
+	}
+
+	// POST method only
+	if req.Method != "POST" {
+		http.Error(w, http.StatusText(403), http.StatusForbidden)
+		return
+	}
+
+	// Prepare response header
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(200)
+
+	// Instantiate a infoReq and infoRes struct to be populated
+	infoReq := infoReq{}
+	response := infoRes{}
+
+	// Populate the infoReq struct with received json request
+	json.NewDecoder(req.Body).Decode(&infoReq)
+
+	info, err := module.GetInfo(filepath.Join(config.AppBasePath, `modules`), infoReq.Name)
+	if err == module.ErrNotFound {
+		response.Status = `failed`
+		response.ErrorMsgs = append(response.ErrorMsgs, `'name' module does not exist`)
+	} else if err != nil {
+		log.Println(`Error reading module`, infoReq.Name, `-`, err)
+		response.Status = `failed`
+		response.ErrorMsgs = append(response.ErrorMsgs, `Cannot read module`)
+	} else {
+		response.Status = `ok`
+		response.Module = &info
+	}
+
+	res, err := json.Marshal(response)
+	if err != nil {
+		log.Println(err)
+	}
+	w.Write(res)
+}
@@ -0,0 +1,57 @@
+package modules
+
+import (
+	"encoding/json"
+	"github.com/miky4u2/RAagent/agent/auth"
+	"github.com/miky4u2/RAagent/agent/config"
+	"github.com/miky4u2/RAagent/agent/module"
+	"log"
+	"net/http"
+	"path/filepath"
+)
+
+type listRes struct {
+	Status    string        `json:"status"`
+	ErrorMsgs []string      `json:"errorMsgs"`
+	Modules   []module.Info `json:"modules"`
+}
+
+// List HTTP handler function
+//
+func List(w http.ResponseWriter, req *http.Request) {
+
+	// Check if the request is authorized, abort if not
+	_, ok := auth.Authorize(req, auth.GroupModules)
+	if !ok {
+		http.Error(w, http.StatusText(403), http.StatusForbidden)
+		return
+	}
+
+	// POST method only
+	if req.Method != "POST" {
+		http.Error(w, http.StatusText(403), http.StatusForbidden)
+		return
+	}
+
+	// Prepare response header
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(200)
+
+	response := listRes{}
+
+	modules, err := module.List(filepath.Join(config.AppBasePath, `modules`))
+	if err != nil {
+		log.Println(`Error listing modules -`, err)
+		response.Status = `failed`
+		response.ErrorMsgs = append(response.ErrorMsgs, `Cannot list modules`)
+	} else {
+		response.Status = `ok`
+		response.Modules = modules
+	}
+
+	res, err := json.Marshal(response)
+	if err != nil {
+		log.Println(err)
+	}
+	w.Write(res)
+}
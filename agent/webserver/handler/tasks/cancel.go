@@ -0,0 +1,109 @@
+package tasks
+
+import (
+	"encoding/json"
+	"github.com/miky4u2/RAagent/agent/audit"
+	"github.com/miky4u2/RAagent/agent/auth"
+	"github.com/miky4u2/RAagent/agent/config"
+	"log"
+	"net/http"
+	"regexp"
+	"time"
+)
+
+type cancelReq struct {
+	UUID string `json:"uuid"`
+}
+
+type cancelRes struct {
+	Status    string   `json:"status"`
+	ErrorMsgs []string `json:"errorMsgs"`
+	UUID      string   `json:"UUID"`
+}
+
+// Cancel HTTP handler function
+//
+func Cancel(w http.ResponseWriter, req *http.Request) {
+	var errMsgs []string
+
+	// Check if the request is authorized, abort if not
+	id, ok := auth.Authorize(req, auth.GroupTasks)
+	rec := audit.Record{Event: `tasks/cancel`, Client: id.String(), IP: id.IP, Result: `unauthorized`}
+	defer func() { audit.Log(rec) }()
+	if !ok {
+		http.Error(w, http.StatusText(403), http.StatusForbidden)
+		return
+	}
+
+	// POST method only
+	rec.Result = `invalid method`
+	if req.Method != "POST" {
+		http.Error(w, http.StatusText(403), http.StatusForbidden)
+		return
+	}
+
+	// Prepare response header
+	w.Header().Set("Content-Type", "application/json")
+
+	// Instantiate a cancelReq and cancelRes struct to be populated
+	cancelReq := cancelReq{}
+	response := cancelRes{}
+
+	// Populate the cancelReq struct with received json request
+	json.NewDecoder(req.Body).Decode(&cancelReq)
+	rec.UUID = cancelReq.UUID
+
+	// Validate received data and signal the running module
+	gracePeriod := time.Duration(config.Settings.TaskCancelGracePeriod) * time.Second
+	if !regexp.MustCompile(`^[a-z0-9\-]+$`).MatchString(cancelReq.UUID) {
+		errMsgs = append(errMsgs, `'UUID' incorrect format`)
+	} else if task, err := store.Get(cancelReq.UUID); err != nil {
+		errMsgs = append(errMsgs, cancelReq.UUID+` task does not exist`)
+		if err != errTaskNotFound {
+			log.Println(err)
+		}
+	} else if err := id.Permit(task.Module, task.Mode, task.Args); err != nil {
+		// The client policies must permit the task being cancelled
+		log.Println(`Denied cancelling task`, cancelReq.UUID, `of module`, task.Module, `for`, id.String(), `:`, err)
+
+		res, err := json.Marshal(deniedRes{Status: `denied`, ErrorMsgs: []string{err.Error()}, Client: id.String(), Module: task.Module, Mode: task.Mode})
+		if err != nil {
+			log.Println(err)
+		}
+		rec.Result = `denied`
+		w.WriteHeader(http.StatusForbidden)
+		w.Write(res)
+		return
+	} else if qt := dequeueTask(cancelReq.UUID); qt != nil {
+		cancelQueuedTask(qt, id.String())
+	} else if !cancelTask(cancelReq.UUID, id.String(), gracePeriod) {
+		errMsgs = append(errMsgs, cancelReq.UUID+` task is not running or is already being cancelled`)
+	}
+
+	response.UUID = cancelReq.UUID
+
+	// If we encountered errors, abort and respond with found errors
+	if len(errMsgs) > 0 {
+		rec.Result = `failed`
+		response.Status = `failed`
+		response.ErrorMsgs = errMsgs
+
+		res, err := json.Marshal(response)
+		if err != nil {
+			log.Println(err)
+		}
+		w.Write(res)
+
+		return
+	}
+
+	// Respond that the task is being cancelled. The final status can be monitored via /tasks/status
+	response.Status = `cancelling`
+	rec.Result = `cancelling`
+
+	res, err := json.Marshal(response)
+	if err != nil {
+		log.Println(err)
+	}
+	w.Write(res)
+}
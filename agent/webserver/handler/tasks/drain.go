@@ -0,0 +1,76 @@
+package tasks
+
+import (
+	"github.com/miky4u2/RAagent/agent/config"
+	"log"
+	"time"
+)
+
+// Extra time given to cancelled modules, after their grace period, to end
+// and have their result stored
+const drainKillWait = 5 * time.Second
+
+// Drain stops task executions before the agent stops. Queued tasks stay
+// queued for the next start, running tasks are waited for until they end
+// and their status is stored. Tasks still running after timeout, or as soon
+// as force is closed, are stopped and marked 'interrupted', detached tasks
+// running an idempotent module being queued again for the next start
+//
+func Drain(timeout time.Duration, force <-chan struct{}) {
+	registry.Lock()
+	registry.draining = true
+	registry.Unlock()
+
+	if n := executingCount(); n > 0 {
+		log.Println(`Waiting up to`, timeout, `for`, n, `running tasks to end`)
+	}
+	deadline := time.NewTimer(timeout)
+	defer deadline.Stop()
+	if waitExecutions(deadline.C, force) {
+		return
+	}
+
+	// Stop remaining tasks, modules are killed straight away on a forced stop
+	gracePeriod := time.Duration(config.Settings.TaskCancelGracePeriod) * time.Second
+	select {
+	case <-force:
+		gracePeriod = 0
+	default:
+	}
+	registry.Lock()
+	var uuids []string
+	for taskUUID, rt := range registry.tasks {
+		if rt.cancelledBy == "" {
+			rt.interrupted = true
+			uuids = append(uuids, taskUUID)
+		}
+	}
+	registry.Unlock()
+	for _, taskUUID := range uuids {
+		cancelTask(taskUUID, `agent shutdown`, gracePeriod)
+	}
+
+	giveUp := time.NewTimer(gracePeriod + drainKillWait)
+	defer giveUp.Stop()
+	if !waitExecutions(giveUp.C, nil) {
+		log.Println(executingCount(), `tasks did not end, stopping anyway`)
+	}
+}
+
+// Waits for all task executions to end. Returns false if stop fires or
+// force is closed first
+//
+func waitExecutions(stop <-chan time.Time, force <-chan struct{}) bool {
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+	for executingCount() > 0 {
+		select {
+		case <-ticker.C:
+		case <-stop:
+			return false
+		case <-force:
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,175 @@
+package tasks
+
+import (
+	"encoding/json"
+	"github.com/miky4u2/RAagent/agent/config"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// queuedTask is a detached task waiting for a free worker
+//
+type queuedTask struct {
+	response   *taskRes
+	modulePath string
+	startTime  time.Time
+}
+
+// Creates a queuedTask for a task read back from its uuid.status file
+//
+func newQueuedTask(response *taskRes) *queuedTask {
+	startTime, err := time.ParseInLocation("2006-01-02 15:04:05", response.StartTime, time.Local)
+	if err != nil {
+		startTime = time.Now()
+	}
+	modulePath := filepath.Join(config.AppBasePath, `modules`, response.Module)
+	return &queuedTask{response: response, modulePath: modulePath, startTime: startTime}
+}
+
+// executor holds the FIFO queue of detached tasks consumed by the worker pool
+//
+var executor = struct {
+	sync.Mutex
+	cond  *sync.Cond
+	queue []*queuedTask
+}{}
+
+// StartExecutor opens the task store, starts the worker pool executing
+// detached tasks, reloads the tasks which were still queued when the agent
+// stopped and recovers the tasks it left running
+//
+func StartExecutor() error {
+	executor.cond = sync.NewCond(&executor.Mutex)
+
+	err := openStore()
+	if err != nil {
+		return err
+	}
+
+	loadQueue()
+
+	executor.Lock()
+	queued := make(map[string]bool)
+	for _, qt := range executor.queue {
+		queued[qt.response.UUID] = true
+	}
+	executor.Unlock()
+
+	for _, qt := range recoverTasks(queued) {
+		enqueueTask(qt.response, qt.modulePath, qt.startTime)
+	}
+
+	for i := 0; i < config.Settings.MaxConcurrentTasks; i++ {
+		go worker()
+	}
+	return nil
+}
+
+// QueuedCount returns the number of detached tasks waiting for a free worker
+//
+func QueuedCount() int {
+	executor.Lock()
+	defer executor.Unlock()
+	return len(executor.queue)
+}
+
+// Adds a task at the end of the queue and persists the queue
+//
+func enqueueTask(response *taskRes, modulePath string, startTime time.Time) {
+	executor.Lock()
+	executor.queue = append(executor.queue, &queuedTask{response: response, modulePath: modulePath, startTime: startTime})
+	saveQueue()
+	executor.Unlock()
+	executor.cond.Signal()
+}
+
+// Removes a task from the queue before it has started.
+// Returns nil if the task is not queued
+//
+func dequeueTask(taskUUID string) *queuedTask {
+	executor.Lock()
+	defer executor.Unlock()
+	for i, qt := range executor.queue {
+		if qt.response.UUID == taskUUID {
+			executor.queue = append(executor.queue[:i], executor.queue[i+1:]...)
+			saveQueue()
+			return qt
+		}
+	}
+	return nil
+}
+
+// Worker executing queued tasks one at a time. Workers stop taking tasks
+// once the agent drains
+//
+func worker() {
+	for {
+		executor.Lock()
+		for len(executor.queue) == 0 || !beginExecution() {
+			executor.cond.Wait()
+		}
+		qt := executor.queue[0]
+		executor.queue = executor.queue[1:]
+		saveQueue()
+		executor.Unlock()
+
+		qt.response.Status = `in progress`
+		taskExec(qt.response, qt.modulePath, qt.startTime, config.Settings.TaskHistoryKeepDays, config.Settings.ValidateNotifyTLS)
+	}
+}
+
+// Writes the UUIDs of queued tasks, in order, to tasks/queue.json.
+// Must be called with the executor locked
+//
+func saveQueue() {
+	uuids := []string{}
+	for _, qt := range executor.queue {
+		uuids = append(uuids, qt.response.UUID)
+	}
+	fileContent, err := json.Marshal(uuids)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	queuePath := filepath.Join(config.AppBasePath, "tasks", "queue.json")
+	err = ioutil.WriteFile(queuePath+".tmp", fileContent, 0644)
+	if err == nil {
+		err = os.Rename(queuePath+".tmp", queuePath)
+	}
+	if err != nil {
+		log.Println(`Failed saving task queue :`, err)
+	}
+}
+
+// Reloads queued tasks from tasks/queue.json and their uuid.status files
+//
+func loadQueue() {
+	fileContent, err := ioutil.ReadFile(filepath.Join(config.AppBasePath, "tasks", "queue.json"))
+	if err != nil {
+		return
+	}
+	var uuids []string
+	err = json.Unmarshal(fileContent, &uuids)
+	if err != nil {
+		log.Println(`Failed loading task queue :`, err)
+		return
+	}
+
+	executor.Lock()
+	defer executor.Unlock()
+	for _, taskUUID := range uuids {
+		task, err := store.Get(taskUUID)
+		if err != nil || task.Status != `queued` {
+			continue
+		}
+		executor.queue = append(executor.queue, newQueuedTask(&task))
+	}
+	saveQueue()
+	if len(executor.queue) > 0 {
+		log.Println(`Reloaded`, len(executor.queue), `queued tasks`)
+	}
+}
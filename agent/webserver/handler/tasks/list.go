@@ -0,0 +1,116 @@
+package tasks
+
+import (
+	"encoding/json"
+	"github.com/miky4u2/RAagent/agent/auth"
+	"log"
+	"net/http"
+	"time"
+)
+
+// Maximum number of tasks returned per page
+const maxPageSize = 500
+
+type listRes struct {
+	Status    string    `json:"status"`
+	ErrorMsgs []string  `json:"errorMsgs"`
+	Total     int       `json:"total"`
+	Page      int       `json:"page"`
+	PageSize  int       `json:"pageSize"`
+	Tasks     []taskRes `json:"tasks"`
+}
+
+// List HTTP handler function
+//
+func List(w http.ResponseWriter, req *http.Request) {
+	var errMsgs []string
+
+	// Check if the request is authorized, abort if not
+	_, ok := auth.Authorize(req, auth.GroupTasks)
+	if !ok {
+		http.Error(w, http.StatusText(403), http.StatusForbidden)
+		return
+	}
+
+	// POST method only
+	if req.Method != "POST" {
+		http.Error(w, http.StatusText(403), http.StatusForbidden)
+		return
+	}
+
+	// Prepare response header
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(200)
+
+	// Instantiate a taskFilter and listRes struct to be populated
+	filter := taskFilter{}
+	response := listRes{}
+
+	// Populate the taskFilter struct with received json request
+	json.NewDecoder(req.Body).Decode(&filter)
+
+	// Validate received data
+	var from, to time.Time
+	var err error
+	if filter.From != "" {
+		from, err = time.ParseInLocation("2006-01-02 15:04:05", filter.From, time.Local)
+		if err != nil {
+			errMsgs = append(errMsgs, `'from' incorrect format, must be YYYY-MM-DD hh:mm:ss`)
+		}
+	}
+	if filter.To != "" {
+		to, err = time.ParseInLocation("2006-01-02 15:04:05", filter.To, time.Local)
+		if err != nil {
+			errMsgs = append(errMsgs, `'to' incorrect format, must be YYYY-MM-DD hh:mm:ss`)
+		}
+	}
+	if filter.Sort == "" {
+		filter.Sort = `desc`
+	}
+	if filter.Sort != `asc` && filter.Sort != `desc` {
+		errMsgs = append(errMsgs, `'sort' must be 'asc' or 'desc'`)
+	}
+	if filter.Page == 0 {
+		filter.Page = 1
+	}
+	if filter.Page < 1 {
+		errMsgs = append(errMsgs, `'page' must be 1 or more`)
+	}
+	if filter.PageSize == 0 {
+		filter.PageSize = 50
+	}
+	if filter.PageSize < 1 || filter.PageSize > maxPageSize {
+		errMsgs = append(errMsgs, `'pageSize' must be between 1 and 500`)
+	}
+
+	// If we encountered errors, abort and respond with found errors
+	if len(errMsgs) > 0 {
+		response.Status = `failed`
+		response.ErrorMsgs = errMsgs
+
+		res, err := json.Marshal(response)
+		if err != nil {
+			log.Println(err)
+		}
+		w.Write(res)
+
+		return
+	}
+
+	// Respond with the requested page of matching tasks
+	response.Status = `ok`
+	response.Page = filter.Page
+	response.PageSize = filter.PageSize
+	response.Tasks, response.Total, err = store.List(filter, from, to)
+	if err != nil {
+		log.Println(err)
+		response.Status = `failed`
+		response.ErrorMsgs = append(response.ErrorMsgs, `Cannot list tasks`)
+	}
+
+	res, err := json.Marshal(response)
+	if err != nil {
+		log.Println(err)
+	}
+	w.Write(res)
+}
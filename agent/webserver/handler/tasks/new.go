@@ -5,19 +5,22 @@ import (
 	"crypto/tls"
 	"encoding/base64"
 	"encoding/json"
+	"github.com/miky4u2/RAagent/agent/audit"
+	"github.com/miky4u2/RAagent/agent/auth"
 	"github.com/miky4u2/RAagent/agent/common"
 	"github.com/miky4u2/RAagent/agent/config"
+	"github.com/miky4u2/RAagent/agent/lifecycle"
+	"github.com/miky4u2/RAagent/agent/module"
 	"github.com/satori/go.uuid"
-	"io/ioutil"
+	"io"
 	"log"
-	"net"
 	"net/http"
-	"os"
 	"os/exec"
 	"path/filepath"
 	"regexp"
 	"strconv"
 	"strings"
+	"sync/atomic"
 	"time"
 )
 
@@ -27,18 +30,37 @@ type taskReq struct {
 	NotifyURL string   `json:"notifyURL"`
 	Module    string   `json:"module"`
 	Args      []string `json:"args"`
+	Timeout   int      `json:"timeout"`
 }
 
 type taskRes struct {
-	UUID      string   `json:"UUID"`
+	UUID        string   `json:"UUID"`
+	Status      string   `json:"status"`
+	ErrorMsgs   []string `json:"errorMsgs"`
+	StartTime   string   `json:"startTime"`
+	EndTime     string   `json:"endTime"`
+	Duration    string   `json:"duration"`
+	Output      string   `json:"output"`
+	Stdout      string   `json:"stdout"`
+	Stderr      string   `json:"stderr"`
+	ExitCode    int      `json:"exitCode"`
+	Signal      string   `json:"signal"`
+	PID         int      `json:"pid"`
+	PIDStart    string   `json:"pidStart"`
+	EndPoint    string   `json:"endPoint"`
+	RemoteIP    string   `json:"remoteIP"`
+	CancelledBy string   `json:"cancelledBy"`
+	CancelledAt string   `json:"cancelledAt"`
+	taskReq
+}
+
+// Response sent when client policies deny a task
+type deniedRes struct {
 	Status    string   `json:"status"`
 	ErrorMsgs []string `json:"errorMsgs"`
-	StartTime string   `json:"startTime"`
-	EndTime   string   `json:"endTime"`
-	Duration  string   `json:"duration"`
-	Output    string   `json:"output"`
-	EndPoint  string   `json:"endPoint"`
-	taskReq
+	Client    string   `json:"client"`
+	Module    string   `json:"module"`
+	Mode      string   `json:"mode"`
 }
 
 // New HTTP handler function
@@ -48,21 +70,28 @@ func New(w http.ResponseWriter, req *http.Request) {
 	startTime := time.Now()
 	var errMsgs []string
 
-	// Check if IP is allowed, abort if not
-	if !common.IsIPAllowed(req, config.Settings.AllowedIPs) {
+	// Check if the request is authorized, abort if not
+	id, ok := auth.Authorize(req, auth.GroupTasks)
+	rec := audit.Record{Event: `tasks/new`, Client: id.String(), IP: id.IP, Result: `unauthorized`}
+	defer func() { audit.Log(rec) }()
+	if !ok {
 		http.Error(w, http.StatusText(403), http.StatusForbidden)
 		return
 	}
 
 	// POST method only
+	rec.Result = `invalid method`
 	if req.Method != "POST" {
 		http.Error(w, http.StatusText(403), http.StatusForbidden)
 		return
 	}
 
-	// Prepare response header
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(200)
+	// No new task while the agent drains before stopping
+	if lifecycle.Draining() {
+		rec.Result = `draining`
+		lifecycle.Refuse(w)
+		return
+	}
 
 	// Instantiate a task and taskRes response struct to be populated
 	task := taskReq{}
@@ -70,6 +99,11 @@ func New(w http.ResponseWriter, req *http.Request) {
 
 	// Populate the task struct with received json request
 	json.NewDecoder(req.Body).Decode(&task)
+	rec.Module = task.Module
+	rec.ArgsHash = audit.HashArgs(task.Args)
+
+	// Prepare response header
+	w.Header().Set("Content-Type", "application/json")
 
 	// Build module path
 	modulePath := filepath.Join(config.AppBasePath, `modules`, task.Module)
@@ -78,24 +112,7 @@ func New(w http.ResponseWriter, req *http.Request) {
 	taskUUID := uuid.NewV4().String()
 
 	// Validate received data
-	if !regexp.MustCompile(`^[a-zA-Z0-9]+[a-zA-Z0-9\.\-_]*$`).MatchString(task.Module) {
-		errMsgs = append(errMsgs, `'module' incorrect format. Must only contain [a-zA-Z0-9.-_] and not start with dot`)
-	} else if !common.FileExists(modulePath) {
-		errMsgs = append(errMsgs, `'module' not supported`)
-	}
-
-	if len(task.Name) < 1 || len(task.Name) > 100 {
-		errMsgs = append(errMsgs, `'name' incorrect length, must be between 1 and 100 chars`)
-	}
-	if len(task.NotifyURL) > 200 {
-		errMsgs = append(errMsgs, `'notifyURL' too long, max 255 chars`)
-	}
-	if len(task.NotifyURL) > 1 && !regexp.MustCompile(`^http(s?)\://`).MatchString(task.NotifyURL) {
-		errMsgs = append(errMsgs, `'notifyURL' must start with http:// or https://`)
-	}
-	if task.Mode != "attached" && task.Mode != "detached" {
-		errMsgs = append(errMsgs, `'mode' must be 'attached' or 'detached'`)
-	}
+	errMsgs = validateTask(&task, modulePath)
 
 	// Pre populate response
 	response.Status = "in progress"
@@ -103,11 +120,17 @@ func New(w http.ResponseWriter, req *http.Request) {
 	response.ErrorMsgs = errMsgs
 	response.StartTime = startTime.Format("2006-01-02 15:04:05")
 	response.EndPoint = req.RequestURI
+	response.RemoteIP = common.GetRemoteIP(req)
 	response.Name = task.Name
 	response.Mode = task.Mode
 	response.NotifyURL = task.NotifyURL
 	response.Module = task.Module
 	response.Args = task.Args
+	response.Timeout = task.Timeout
+	response.ExitCode = -1
+	rec.UUID = taskUUID
+	rec.Mode = task.Mode
+	rec.Result = `failed`
 
 	// If we have any errors, abort now and send the response with the error messages
 	if len(errMsgs) > 0 {
@@ -126,17 +149,37 @@ func New(w http.ResponseWriter, req *http.Request) {
 		return
 	}
 
-	// Log module execution attempt
-	userIP := "unknown"
-	remoteAddress, _, err := net.SplitHostPort(req.RemoteAddr)
-	if err == nil {
-		userIP = net.ParseIP(remoteAddress).String()
+	// Check the client policies, abort if the task is not permitted
+	err := id.Permit(task.Module, task.Mode, task.Args)
+	if err != nil {
+		log.Println(`Denied module`, task.Module, `in`, task.Mode, `mode for`, id.String(), `:`, err)
+
+		res, err := json.Marshal(deniedRes{Status: `denied`, ErrorMsgs: []string{err.Error()}, Client: id.String(), Module: task.Module, Mode: task.Mode})
+		if err != nil {
+			log.Println(err)
+		}
+		rec.Result = `denied`
+		w.WriteHeader(http.StatusForbidden)
+		w.Write(res)
+		return
 	}
-	log.Println(`Executing module`, response.Module, `in`, task.Mode, `mode for IP`, userIP)
+
+	// Log module execution attempt
+	log.Println(`Executing module`, response.Module, `in`, task.Mode, `mode for`, id.String())
 
 	// Execute module now and send response
 	if task.Mode == "attached" {
+		if !beginExecution() {
+			rec.Result = `draining`
+			lifecycle.Refuse(w)
+			return
+		}
+		err := store.Create(&response)
+		if err != nil {
+			log.Println(err)
+		}
 		taskExec(&response, modulePath, startTime, config.Settings.TaskHistoryKeepDays, config.Settings.ValidateNotifyTLS)
+		rec.Result = response.Status
 
 		res, err := json.Marshal(response)
 		if err != nil {
@@ -146,58 +189,103 @@ func New(w http.ResponseWriter, req *http.Request) {
 		return
 	}
 
-	// Instantiate a Go routine for this task's execution and
-	// send 'in progress' response. The task status can then be monitored via api call to /tasks/status
+	// Queue the task for execution by the worker pool and
+	// send 'queued' response. The task status can then be monitored via api call to /tasks/status
 	if task.Mode == "detached" {
-		go taskExec(&response, modulePath, startTime, config.Settings.TaskHistoryKeepDays, config.Settings.ValidateNotifyTLS)
+		response.Status = "queued"
+		err := store.Create(&response)
+		if err != nil {
+			log.Println(err)
+		}
 
-		// Send response
+		// Prepare the response before the task is handed over to a worker
 		res, err := json.Marshal(response)
 		if err != nil {
 			log.Println(err)
 		}
+		enqueueTask(&response, modulePath, startTime)
+		rec.Result = `queued`
+
+		// Send response
 		w.Write(res)
 		return
 	}
 
 }
 
-// Executes module
+// Validates a task request, applying the module manifest defaults and the
+// default timeout. Returns the validation errors
+//
+func validateTask(task *taskReq, modulePath string) []string {
+	var errMsgs []string
+
+	if !module.NameRegex.MatchString(task.Module) {
+		errMsgs = append(errMsgs, `'module' incorrect format. Must only contain [a-zA-Z0-9.-_] and not start with dot`)
+	} else if module.IsManifest(task.Module) || !common.FileExists(modulePath) {
+		errMsgs = append(errMsgs, `'module' not supported`)
+	} else {
+		// Validate arguments against the module manifest, if any
+		manifest, err := module.LoadManifest(filepath.Join(config.AppBasePath, `modules`), task.Module)
+		if err != nil {
+			log.Println(`Invalid manifest for module '`+task.Module+`' :`, err)
+			errMsgs = append(errMsgs, `'module' has an invalid manifest`)
+		} else if manifest != nil {
+			errMsgs = append(errMsgs, manifest.ValidateArgs(task.Args)...)
+			if task.Mode == "" {
+				task.Mode = manifest.DefaultMode
+			}
+			if task.Timeout == 0 {
+				task.Timeout = manifest.Timeout
+				if config.Settings.TaskMaxTimeout > 0 && task.Timeout > config.Settings.TaskMaxTimeout {
+					task.Timeout = config.Settings.TaskMaxTimeout
+				}
+			}
+		}
+	}
+
+	if len(task.Name) < 1 || len(task.Name) > 100 {
+		errMsgs = append(errMsgs, `'name' incorrect length, must be between 1 and 100 chars`)
+	}
+	if len(task.NotifyURL) > 200 {
+		errMsgs = append(errMsgs, `'notifyURL' too long, max 255 chars`)
+	}
+	if len(task.NotifyURL) > 1 && !regexp.MustCompile(`^http(s?)\://`).MatchString(task.NotifyURL) {
+		errMsgs = append(errMsgs, `'notifyURL' must start with http:// or https://`)
+	}
+	if task.Mode != "attached" && task.Mode != "detached" {
+		errMsgs = append(errMsgs, `'mode' must be 'attached' or 'detached'`)
+	}
+	if task.Timeout < 0 || (config.Settings.TaskMaxTimeout > 0 && task.Timeout > config.Settings.TaskMaxTimeout) {
+		errMsgs = append(errMsgs, `'timeout' must be between 0 and `+strconv.Itoa(config.Settings.TaskMaxTimeout)+` seconds`)
+	}
+
+	// Use the default timeout when none was provided
+	if task.Timeout == 0 {
+		task.Timeout = config.Settings.TaskDefaultTimeout
+	}
+
+	return errMsgs
+}
+
+// Executes module. The execution must have been counted with beginExecution
 //
 func taskExec(response *taskRes, modulePath string, startTime time.Time, taskHistoryKeepDays int, validateNotifyTLS bool) {
+	defer endExecution()
 
 	cmdArgs := response.Args
 
 	var errMsgs []string
 
-	// Create a new uuid.status file for this task
-	// This file is used when a task status is queried via /tasks/status
-	fileContent, err := json.MarshalIndent(response, "", " ")
-	if err != nil {
-		log.Println(err)
-	}
-	err = ioutil.WriteFile(filepath.Join(config.AppBasePath, "tasks", response.UUID+".status"), fileContent, 0644)
+	// Store the task as in progress
+	// This is used when a task status is queried via /tasks/status
+	err := store.Update(response)
 	if err != nil {
 		log.Println(err)
 	}
 
 	// For .cmd special modules, parse module file to obtain command and arguments
 	if strings.HasSuffix(modulePath, `.cmd`) {
-
-		// Struct to hold json content of cmd file
-		var cmdContent = struct {
-			Cmd  string   `json:"cmd"`
-			Args []string `json:"args"`
-		}{}
-
-		cmdFile, err := os.Open(modulePath)
-		defer cmdFile.Close()
-		if err != nil {
-			log.Println(err)
-		}
-
-		jasonParser := json.NewDecoder(cmdFile)
-		err = jasonParser.Decode(&cmdContent)
+		cmdContent, err := module.ReadCmd(modulePath)
 		if err != nil {
 			log.Println(err)
 		}
@@ -208,49 +296,127 @@ func taskExec(response *taskRes, modulePath string, startTime time.Time, taskHis
 	}
 
 	cmd := exec.Command(modulePath, cmdArgs[0:]...)
+	setProcessGroup(cmd)
+
+	// Keep stdout and stderr apart while also collecting them merged for the
+	// legacy output field and for output streams
+	output := newOutputBuffer()
+	stdout := bytes.Buffer{}
+	stderr := bytes.Buffer{}
+	cmd.Stdout = io.MultiWriter(output, &stdout)
+	cmd.Stderr = io.MultiWriter(output, &stderr)
+
+	// timerFired is set by the timeout timer before it kills the module
+	timedOut := false
+	var timerFired int32
+	var rt *runningTask
+	err = cmd.Start()
+	if err == nil {
+		registerTask(response.UUID, response.Module, cmd, output)
 
-	output := bytes.Buffer{}
-	cmd.Stderr = &output
-	cmd.Stdout = &output
+		// Record the module PID and start so that the task can be recovered if the agent stops while it runs
+		response.PID = cmd.Process.Pid
+		response.PIDStart = processStart(response.PID)
+		err = store.Update(response)
+		if err != nil {
+			log.Println(err)
+		}
 
-	err = cmd.Run()
-	if err != nil {
+		// Kill the whole module process tree if the task runs past its timeout
+		var timer *time.Timer
+		if response.Timeout > 0 {
+			timer = time.AfterFunc(time.Duration(response.Timeout)*time.Second, func() {
+				atomic.StoreInt32(&timerFired, 1)
+				log.Println(`Module '`+response.Module+`' timed out after`, response.Timeout, `seconds, killing it`)
+				err := killProcessTree(cmd)
+				if err != nil {
+					log.Println(`Failed killing module '`+response.Module+`' :`, err)
+				}
+			})
+		}
+		err = cmd.Wait()
+		if timer != nil {
+			timer.Stop()
+			timedOut = atomic.LoadInt32(&timerFired) == 1
+		}
+		rt = unregisterTask(response.UUID)
+	}
+	// Tasks stopped by an agent shutdown are interrupted rather than cancelled
+	interrupted := rt != nil && rt.interrupted
+	cancelled := !interrupted && rt != nil && rt.cancelledBy != ""
+	if interrupted {
+		// Status and error message are set by interruptTask
+	} else if cancelled {
+		errMsgs = append(errMsgs, `Task cancelled by `+rt.cancelledBy)
+		response.CancelledBy = rt.cancelledBy
+		response.CancelledAt = rt.cancelledAt.Format("2006-01-02 15:04:05")
+	} else if timedOut {
+		errMsgs = append(errMsgs, `Module execution timed out after `+strconv.Itoa(response.Timeout)+` seconds`)
+	} else if err != nil {
 		errMsgs = append(errMsgs, `Module execution error: `+err.Error())
 		log.Println(`Module '`+response.Module+`' execution error: `, err)
 	}
 
-	// Write response to uuid.status file
+	// Store the task result
 	endTime := time.Now()
 	duration := endTime.Sub(startTime)
-	if len(errMsgs) > 0 {
+	if cancelled {
+		response.Status = "cancelled"
+	} else if timedOut {
+		response.Status = "timeout"
+	} else if len(errMsgs) > 0 {
 		response.Status = "failed"
 	} else {
 		response.Status = "done"
 	}
 	response.ErrorMsgs = errMsgs
 	response.Output = base64.StdEncoding.EncodeToString(output.Bytes())
+	response.Stdout = base64.StdEncoding.EncodeToString(stdout.Bytes())
+	response.Stderr = base64.StdEncoding.EncodeToString(stderr.Bytes())
+	if cmd.ProcessState != nil {
+		response.ExitCode = cmd.ProcessState.ExitCode()
+		response.Signal = processSignal(cmd.ProcessState)
+	}
 	response.EndTime = endTime.Format("2006-01-02 15:04:05")
 	response.Duration = duration.String()
 
-	fileContent, err = json.MarshalIndent(response, "", " ")
-	if err != nil {
-		log.Println(err)
+	if interrupted {
+		// Stored, reported and queued again if idempotent, as tasks
+		// recovered from a previous agent run
+		interruptTask(response)
+		output.Close(`interrupted`)
+	} else {
+		err = store.Update(response)
+		if err != nil {
+			log.Println(err)
+		}
+
+		// Let output stream readers know the task is complete
+		output.Close(response.Status)
+
+		// Notify URL if a url is provided, and RAserver if the task was pulled from it
+		reportTask(response, validateNotifyTLS)
 	}
-	err = ioutil.WriteFile(filepath.Join(config.AppBasePath, "tasks", response.UUID+".status"), fileContent, 0644)
+
+	// Tidy up, remove old tasks
+	err = store.Prune(taskHistoryKeepDays)
 	if err != nil {
 		log.Println(err)
 	}
 
-	// Notify URL if a url is provided
+	return
+}
+
+// Reports a completed task to its notifyURL, if any, and to RAserver
+// when the task was pulled from it
+//
+func reportTask(response *taskRes, validateNotifyTLS bool) {
 	if response.NotifyURL != "" {
 		notifyURL(response, validateNotifyTLS)
-
 	}
-
-	// Tidy up, remove old task files
-	common.DeleteOldFiles(filepath.Join(config.AppBasePath, "tasks"), taskHistoryKeepDays)
-
-	return
+	if isPulledTask(response) {
+		queueResult(response.UUID)
+	}
 }
 
 // Sends json response to provided notifyURL
@@ -0,0 +1,68 @@
+package tasks
+
+import (
+	"bytes"
+	"sync"
+)
+
+// outputBuffer collects a module's output while it runs and lets
+// any number of readers follow it as it grows
+//
+type outputBuffer struct {
+	mu     sync.Mutex
+	buf    bytes.Buffer
+	notify chan struct{}
+	closed bool
+	status string
+}
+
+// Creates a new empty outputBuffer
+//
+func newOutputBuffer() *outputBuffer {
+	return &outputBuffer{notify: make(chan struct{})}
+}
+
+// Write appends module output and wakes up waiting readers
+//
+func (o *outputBuffer) Write(p []byte) (int, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	n, err := o.buf.Write(p)
+	close(o.notify)
+	o.notify = make(chan struct{})
+	return n, err
+}
+
+// Bytes returns a copy of all output collected so far
+//
+func (o *outputBuffer) Bytes() []byte {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return append([]byte(nil), o.buf.Bytes()...)
+}
+
+// Close marks the output as complete with the final task status
+//
+func (o *outputBuffer) Close(status string) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.closed {
+		return
+	}
+	o.closed = true
+	o.status = status
+	close(o.notify)
+}
+
+// ReadFrom returns the output produced after offset, a channel closed on
+// the next write and, once the output is complete, the final task status
+//
+func (o *outputBuffer) ReadFrom(offset int) ([]byte, <-chan struct{}, bool, string) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	var data []byte
+	if offset < o.buf.Len() {
+		data = append([]byte(nil), o.buf.Bytes()[offset:]...)
+	}
+	return data, o.notify, o.closed, o.status
+}
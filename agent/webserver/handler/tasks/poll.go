@@ -0,0 +1,352 @@
+package tasks
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"github.com/miky4u2/RAagent/agent/audit"
+	"github.com/miky4u2/RAagent/agent/common"
+	"github.com/miky4u2/RAagent/agent/config"
+	"github.com/miky4u2/RAagent/agent/lifecycle"
+	"github.com/satori/go.uuid"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// RAserver endpoints used in pull mode
+const (
+	pollPath   = `/api/tasks/poll`
+	resultPath = `/api/tasks/result`
+)
+
+// polledTask is a task received from RAserver. It is the same json as a
+// /tasks/new request, with an optional UUID chosen by the server
+//
+type polledTask struct {
+	UUID string `json:"uuid"`
+	taskReq
+}
+
+// results holds the UUIDs of pulled tasks whose result is still to be posted to RAserver
+//
+var results = struct {
+	sync.Mutex
+	pending []string
+	wake    chan struct{}
+}{wake: make(chan struct{}, 1)}
+
+// Transport shared by the requests to RAserver
+var serverTransport *http.Transport
+
+// StartPoller starts polling RAserver for tasks when pullMode is enabled,
+// and posting the results of pulled tasks back, including those which
+// could not be posted before the agent stopped
+//
+func StartPoller() {
+	if !config.Settings.PullMode {
+		return
+	}
+
+	serverTransport = &http.Transport{
+		TLSClientConfig: common.ServerTLSConfig(),
+	}
+
+	loadResults()
+
+	log.Println(`Pull mode enabled, polling`, config.Settings.ServerURL+pollPath, `for tasks`)
+	go pollTasks()
+	go postResults()
+}
+
+// Checks if a task was pulled from RAserver
+//
+func isPulledTask(response *taskRes) bool {
+	return config.Settings.ServerURL != "" && response.EndPoint == config.Settings.ServerURL+pollPath
+}
+
+// Long polls RAserver for tasks and runs them. Polling goes on after
+// network or server errors, with an increasing delay, until the agent drains
+//
+func pollTasks() {
+	backoff := time.Second
+	interval := time.Duration(config.Settings.PollInterval) * time.Second
+	for !lifecycle.Draining() {
+		pollStart := time.Now()
+		task, err := pollTask()
+		if err != nil {
+			log.Println(`Polling RAserver failed, retrying in`, backoff, `:`, err)
+			time.Sleep(backoff)
+			backoff = nextBackoff(backoff)
+			continue
+		}
+		backoff = time.Second
+
+		if task != nil {
+			runPolledTask(task)
+			continue
+		}
+
+		// Do not poll more often than pollInterval when the server answers straight away
+		if elapsed := time.Since(pollStart); elapsed < interval {
+			time.Sleep(interval - elapsed)
+		}
+	}
+}
+
+// Asks RAserver for a pending task, waiting up to pollWait seconds for one.
+// Returns nil without error when there is no task
+//
+func pollTask() (*polledTask, error) {
+	pollReq := struct {
+		AgentID string `json:"agentID"`
+		Wait    int    `json:"wait"`
+	}{config.Settings.AgentID, config.Settings.PollWait}
+
+	res, err := postToServer(pollPath, pollReq, time.Duration(config.Settings.PollWait+30)*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode == http.StatusNoContent {
+		return nil, nil
+	}
+	if res.StatusCode != http.StatusOK {
+		return nil, errors.New(`received status code ` + strconv.Itoa(res.StatusCode))
+	}
+
+	task := &polledTask{}
+	err = json.NewDecoder(io.LimitReader(res.Body, 1024*1024)).Decode(task)
+	if err != nil {
+		return nil, err
+	}
+	return task, nil
+}
+
+// Validates and runs a task received from RAserver, the same way as a task
+// sent to /tasks/new. Client policies do not apply, RAserver is trusted
+//
+func runPolledTask(pt *polledTask) {
+	startTime := time.Now()
+	task := pt.taskReq
+
+	// Use the UUID chosen by the server, if valid
+	taskUUID := uuid.NewV4().String()
+	if serverUUID, err := uuid.FromString(pt.UUID); err == nil {
+		taskUUID = serverUUID.String()
+	}
+
+	// A task received again, as the connection was lost before the server got the
+	// poll response, is not run twice. Its result is sent again if already known
+	if existing, err := store.Get(taskUUID); err == nil {
+		log.Println(`Ignoring task`, taskUUID, `received again from RAserver`)
+		if existing.Status != `queued` && existing.Status != `in progress` {
+			queueResult(taskUUID)
+		}
+		return
+	}
+
+	serverHost := config.Settings.ServerURL
+	if serverURL, err := url.Parse(config.Settings.ServerURL); err == nil {
+		serverHost = serverURL.Hostname()
+	}
+
+	modulePath := filepath.Join(config.AppBasePath, `modules`, task.Module)
+	errMsgs := validateTask(&task, modulePath)
+
+	response := taskRes{}
+	response.Status = "in progress"
+	response.UUID = taskUUID
+	response.ErrorMsgs = errMsgs
+	response.StartTime = startTime.Format("2006-01-02 15:04:05")
+	response.EndPoint = config.Settings.ServerURL + pollPath
+	response.RemoteIP = serverHost
+	response.Name = task.Name
+	response.Mode = task.Mode
+	response.NotifyURL = task.NotifyURL
+	response.Module = task.Module
+	response.Args = task.Args
+	response.Timeout = task.Timeout
+	response.ExitCode = -1
+
+	rec := audit.Record{Event: `tasks/poll`, Client: `server`, IP: serverHost, UUID: taskUUID, Module: task.Module, Mode: task.Mode, ArgsHash: audit.HashArgs(task.Args)}
+	defer func() { audit.Log(rec) }()
+
+	// If we have any errors, report the task as failed to the server
+	if len(errMsgs) > 0 {
+		endTime := time.Now()
+		response.Status = `failed`
+		response.EndTime = endTime.Format("2006-01-02 15:04:05")
+		response.Duration = endTime.Sub(startTime).String()
+		rec.Result = `failed`
+
+		err := store.Create(&response)
+		if err != nil {
+			log.Println(err)
+		}
+		reportTask(&response, config.Settings.ValidateNotifyTLS)
+		return
+	}
+
+	log.Println(`Executing module`, response.Module, `in`, task.Mode, `mode for RAserver`)
+
+	// No client waits for a pulled task, so attached tasks also go through the
+	// worker pool and its maxConcurrentTasks limit
+	rec.Result = `queued`
+	response.Status = "queued"
+	err := store.Create(&response)
+	if err != nil {
+		log.Println(err)
+	}
+	enqueueTask(&response, modulePath, startTime)
+}
+
+// Adds a task to the results to post to RAserver
+//
+func queueResult(taskUUID string) {
+	results.Lock()
+	defer results.Unlock()
+
+	for _, pending := range results.pending {
+		if pending == taskUUID {
+			return
+		}
+	}
+	results.pending = append(results.pending, taskUUID)
+	saveResults()
+
+	select {
+	case results.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Posts the results of pulled tasks to RAserver, in order. A result is kept
+// and posted again, with an increasing delay, until the server accepts it
+//
+func postResults() {
+	backoff := time.Second
+	for {
+		results.Lock()
+		for len(results.pending) == 0 {
+			results.Unlock()
+			<-results.wake
+			results.Lock()
+		}
+		taskUUID := results.pending[0]
+		results.Unlock()
+
+		task, err := store.Get(taskUUID)
+		if err == nil {
+			err = postResult(&task)
+		}
+		if err != nil && err != errTaskNotFound {
+			log.Println(`Posting result of task`, taskUUID, `to RAserver failed, retrying in`, backoff, `:`, err)
+			time.Sleep(backoff)
+			backoff = nextBackoff(backoff)
+			continue
+		}
+		backoff = time.Second
+
+		results.Lock()
+		results.pending = results.pending[1:]
+		saveResults()
+		results.Unlock()
+	}
+}
+
+// Posts the result of a task to RAserver
+//
+func postResult(task *taskRes) error {
+	resultReq := struct {
+		AgentID string   `json:"agentID"`
+		Task    *taskRes `json:"task"`
+	}{config.Settings.AgentID, task}
+
+	res, err := postToServer(resultPath, resultReq, 30*time.Second)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return errors.New(`received status code ` + strconv.Itoa(res.StatusCode))
+	}
+	return nil
+}
+
+// Posts a json request to a RAserver endpoint
+//
+func postToServer(path string, content interface{}, timeout time.Duration) (*http.Response, error) {
+	reqContent, err := json.Marshal(content)
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequest("POST", config.Settings.ServerURL+path, bytes.NewReader(reqContent))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	client := &http.Client{Transport: serverTransport, Timeout: timeout}
+	return client.Do(req)
+}
+
+// Returns the next retry delay, doubled up to pollMaxBackoff
+//
+func nextBackoff(backoff time.Duration) time.Duration {
+	backoff *= 2
+	maxBackoff := time.Duration(config.Settings.PollMaxBackoff) * time.Second
+	if backoff > maxBackoff {
+		backoff = maxBackoff
+	}
+	return backoff
+}
+
+// Saves the UUIDs of the results to post into tasks/results.json, so that they
+// are posted after an agent restart. Must be called with the results lock held
+//
+func saveResults() {
+	fileContent, err := json.Marshal(results.pending)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	resultsPath := filepath.Join(config.AppBasePath, "tasks", "results.json")
+	err = ioutil.WriteFile(resultsPath+".tmp", fileContent, 0644)
+	if err == nil {
+		err = os.Rename(resultsPath+".tmp", resultsPath)
+	}
+	if err != nil {
+		log.Println(`Failed saving pending task results :`, err)
+	}
+}
+
+// Reloads the UUIDs of the results to post from tasks/results.json
+//
+func loadResults() {
+	fileContent, err := ioutil.ReadFile(filepath.Join(config.AppBasePath, "tasks", "results.json"))
+	if err != nil {
+		return
+	}
+
+	results.Lock()
+	defer results.Unlock()
+	err = json.Unmarshal(fileContent, &results.pending)
+	if err != nil {
+		log.Println(`Failed loading pending task results :`, err)
+		return
+	}
+	if len(results.pending) > 0 {
+		results.wake <- struct{}{}
+	}
+}
@@ -0,0 +1,232 @@
+package tasks
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"github.com/miky4u2/RAagent/agent/config"
+	"github.com/satori/go.uuid"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// stubServer stands in for RAserver: it hands out queued tasks on the poll
+// endpoint and collects the results posted back. While down, or while
+// dropResults is set for the result endpoint, connections are closed
+// without an answer
+//
+type stubServer struct {
+	sync.Mutex
+	tasks       []polledTask
+	results     map[string]taskRes
+	attempts    map[string]int
+	down        bool
+	dropResults bool
+}
+
+func (s *stubServer) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	s.Lock()
+	s.attempts[req.URL.Path]++
+	drop := s.down || (s.dropResults && req.URL.Path == resultPath)
+	s.Unlock()
+
+	if drop {
+		conn, _, err := w.(http.Hijacker).Hijack()
+		if err == nil {
+			conn.Close()
+		}
+		return
+	}
+
+	switch req.URL.Path {
+	case pollPath:
+		s.Lock()
+		defer s.Unlock()
+		if len(s.tasks) == 0 {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		task := s.tasks[0]
+		s.tasks = s.tasks[1:]
+		json.NewEncoder(w).Encode(task)
+	case resultPath:
+		resultReq := struct {
+			AgentID string  `json:"agentID"`
+			Task    taskRes `json:"task"`
+		}{}
+		json.NewDecoder(req.Body).Decode(&resultReq)
+		s.Lock()
+		s.results[resultReq.Task.UUID] = resultReq.Task
+		s.Unlock()
+	default:
+		http.NotFound(w, req)
+	}
+}
+
+// Queues a task for the agent and returns its UUID
+//
+func (s *stubServer) addTask(mode string, args ...string) string {
+	task := polledTask{UUID: uuid.NewV4().String()}
+	task.Name = `test ` + mode
+	task.Module = `echo_args`
+	task.Mode = mode
+	task.Args = args
+
+	s.Lock()
+	defer s.Unlock()
+	s.tasks = append(s.tasks, task)
+	return task.UUID
+}
+
+func (s *stubServer) result(taskUUID string) (taskRes, bool) {
+	s.Lock()
+	defer s.Unlock()
+	task, ok := s.results[taskUUID]
+	return task, ok
+}
+
+func (s *stubServer) attemptsTo(path string) int {
+	s.Lock()
+	defer s.Unlock()
+	return s.attempts[path]
+}
+
+func (s *stubServer) set(down bool, dropResults bool) {
+	s.Lock()
+	defer s.Unlock()
+	s.down = down
+	s.dropResults = dropResults
+}
+
+// Waits up to timeout for cond to be true
+//
+func waitFor(t *testing.T, timeout time.Duration, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(timeout)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal(`timed out waiting for`, what)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+// Sets up an agent base folder with an echo_args module, pointed at a stub
+// RAserver whose certificate is pinned with serverCAFile, and starts the
+// executor and the poller
+//
+func startPullMode(t *testing.T) *stubServer {
+	if runtime.GOOS == `windows` {
+		t.Skip(`the test module is a shell script`)
+	}
+
+	basePath, err := ioutil.TempDir("", "raagent")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(basePath) })
+	for _, dir := range []string{`modules`, `tasks`, `conf`} {
+		err = os.Mkdir(filepath.Join(basePath, dir), 0755)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = ioutil.WriteFile(filepath.Join(basePath, `modules`, `echo_args`), []byte("#!/bin/sh\necho \"$@\"\n"), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stub := &stubServer{results: make(map[string]taskRes), attempts: make(map[string]int)}
+	server := httptest.NewTLSServer(stub)
+	t.Cleanup(server.Close)
+	caFile := filepath.Join(basePath, `conf`, `server.pem`)
+	err = ioutil.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: `CERTIFICATE`, Bytes: server.Certificate().Raw}), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	config.AppBasePath = basePath
+	config.Settings.AgentID = `test-agent`
+	config.Settings.ServerURL = server.URL
+	config.Settings.ServerCAFile = caFile
+	config.Settings.PullMode = true
+	config.Settings.PollWait = 1
+	config.Settings.PollInterval = 1
+	config.Settings.PollMaxBackoff = 1
+	config.Settings.TaskStore = `file`
+	config.Settings.TaskHistoryKeepDays = 1
+	config.Settings.TaskCancelGracePeriod = 1
+	config.Settings.MaxConcurrentTasks = 2
+
+	err = StartExecutor()
+	if err != nil {
+		t.Fatal(err)
+	}
+	StartPoller()
+	return stub
+}
+
+func TestPullMode(t *testing.T) {
+	stub := startPullMode(t)
+
+	// Tasks are polled, run in both modes and their results posted back
+	for _, mode := range []string{`detached`, `attached`} {
+		taskUUID := stub.addTask(mode, `hello`, mode)
+		waitFor(t, 10*time.Second, mode+` task result`, func() bool {
+			_, ok := stub.result(taskUUID)
+			return ok
+		})
+		task, _ := stub.result(taskUUID)
+		stdout, _ := base64.StdEncoding.DecodeString(task.Stdout)
+		if task.Status != `done` || string(stdout) != "hello "+mode+"\n" {
+			t.Errorf(`%s task: got status %q and stdout %q`, mode, task.Status, stdout)
+		}
+	}
+
+	// Results which cannot be posted are kept in tasks/results.json and retried
+	stub.set(false, true)
+	taskUUID := stub.addTask(`detached`, `kept`)
+	waitFor(t, 10*time.Second, `result post retries`, func() bool { return stub.attemptsTo(resultPath) >= 5 })
+	pending, _ := ioutil.ReadFile(filepath.Join(config.AppBasePath, `tasks`, `results.json`))
+	if !strings.Contains(string(pending), taskUUID) {
+		t.Errorf(`results.json does not hold the unposted result: %s`, pending)
+	}
+	stub.set(false, false)
+	waitFor(t, 10*time.Second, `result posted after the server came back`, func() bool {
+		_, ok := stub.result(taskUUID)
+		return ok
+	})
+
+	// While the server is gone, polling backs off, then resumes once it is back
+	stub.set(true, false)
+	before := stub.attemptsTo(pollPath)
+	time.Sleep(3 * time.Second)
+	if attempts := stub.attemptsTo(pollPath) - before; attempts < 1 || attempts > 4 {
+		t.Errorf(`got %d poll attempts in 3s while the server was down, want 1 to 4 with a 1s backoff`, attempts)
+	}
+	stub.set(false, false)
+	taskUUID = stub.addTask(`detached`, `resumed`)
+	waitFor(t, 10*time.Second, `task polled after the server came back`, func() bool {
+		_, ok := stub.result(taskUUID)
+		return ok
+	})
+}
+
+func TestNextBackoff(t *testing.T) {
+	config.Settings.PollMaxBackoff = 4
+	backoff := time.Second
+	for _, want := range []time.Duration{2 * time.Second, 4 * time.Second, 4 * time.Second} {
+		backoff = nextBackoff(backoff)
+		if backoff != want {
+			t.Errorf(`got backoff %s, want %s`, backoff, want)
+		}
+	}
+}
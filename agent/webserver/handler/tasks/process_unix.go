@@ -0,0 +1,126 @@
+//go:build !windows
+// +build !windows
+
+package tasks
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// Starts the module in its own process group so that the whole
+// process tree can be signalled at once
+//
+func setProcessGroup(cmd *exec.Cmd) {
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+}
+
+// Kills the module and every process it spawned
+//
+func killProcessTree(cmd *exec.Cmd) error {
+	if cmd.Process == nil {
+		return nil
+	}
+	return syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+}
+
+// Asks the module and every process it spawned to terminate
+//
+func terminateProcessTree(cmd *exec.Cmd) error {
+	if cmd.Process == nil {
+		return nil
+	}
+	return syscall.Kill(-cmd.Process.Pid, syscall.SIGTERM)
+}
+
+// Names of the signals most likely to end a module
+//
+var signalNames = map[syscall.Signal]string{
+	syscall.SIGHUP:  `SIGHUP`,
+	syscall.SIGINT:  `SIGINT`,
+	syscall.SIGQUIT: `SIGQUIT`,
+	syscall.SIGILL:  `SIGILL`,
+	syscall.SIGABRT: `SIGABRT`,
+	syscall.SIGBUS:  `SIGBUS`,
+	syscall.SIGFPE:  `SIGFPE`,
+	syscall.SIGKILL: `SIGKILL`,
+	syscall.SIGSEGV: `SIGSEGV`,
+	syscall.SIGPIPE: `SIGPIPE`,
+	syscall.SIGALRM: `SIGALRM`,
+	syscall.SIGTERM: `SIGTERM`,
+	syscall.SIGUSR1: `SIGUSR1`,
+	syscall.SIGUSR2: `SIGUSR2`,
+}
+
+// Returns the name of the signal which killed the module or an empty string
+// if the module exited on its own
+//
+func processSignal(state *os.ProcessState) string {
+	if state == nil {
+		return ""
+	}
+	ws, ok := state.Sys().(syscall.WaitStatus)
+	if !ok || !ws.Signaled() {
+		return ""
+	}
+	if name, ok := signalNames[ws.Signal()]; ok {
+		return name
+	}
+	return ws.Signal().String()
+}
+
+// Returns when a process started, as its start time in clock ticks since
+// boot along with the boot ID, or an empty string where /proc is not
+// available
+//
+func processStart(pid int) string {
+	_, start := procStat(pid)
+	return start
+}
+
+// Checks if the process which started at start is still running. A PID
+// reused after a reboot or by another process does not match start, and
+// zombie processes waiting to be reaped by their new parent are not
+// considered running. start is ignored when empty
+//
+func processExists(pid int, start string) bool {
+	err := syscall.Kill(pid, 0)
+	if err != nil && err != syscall.EPERM {
+		return false
+	}
+	state, started := procStat(pid)
+	if state == 'Z' {
+		return false
+	}
+	return start == "" || started == start
+}
+
+// Reads the state and start of a process from /proc/<pid>/stat
+//
+func procStat(pid int) (byte, string) {
+	stat, err := ioutil.ReadFile(`/proc/` + strconv.Itoa(pid) + `/stat`)
+	if err != nil {
+		return 0, ""
+	}
+	bootID, err := ioutil.ReadFile(`/proc/sys/kernel/random/boot_id`)
+	if err != nil {
+		return 0, ""
+	}
+
+	// The command name may hold spaces, fields are counted from its closing
+	// parenthesis: state is field 3 and starttime field 22
+	i := bytes.LastIndexByte(stat, ')')
+	if i < 0 {
+		return 0, ""
+	}
+	fields := strings.Fields(string(stat[i+1:]))
+	if len(fields) < 20 {
+		return 0, ""
+	}
+	return fields[0][0], strings.TrimSpace(string(bootID)) + `/` + fields[19]
+}
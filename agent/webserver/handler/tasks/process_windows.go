@@ -0,0 +1,87 @@
+//go:build windows
+// +build windows
+
+package tasks
+
+import (
+	"os"
+	"os/exec"
+	"strconv"
+	"syscall"
+)
+
+// Starts the module in a new process group so that it does not receive
+// console events sent to the agent
+//
+func setProcessGroup(cmd *exec.Cmd) {
+	cmd.SysProcAttr = &syscall.SysProcAttr{CreationFlags: syscall.CREATE_NEW_PROCESS_GROUP}
+}
+
+// Kills the module and every process it spawned using taskkill /T
+//
+func killProcessTree(cmd *exec.Cmd) error {
+	if cmd.Process == nil {
+		return nil
+	}
+	err := exec.Command(`taskkill`, `/T`, `/F`, `/PID`, strconv.Itoa(cmd.Process.Pid)).Run()
+	if err != nil {
+		return cmd.Process.Kill()
+	}
+	return nil
+}
+
+// Asks the module and every process it spawned to close using taskkill /T
+// without /F
+//
+func terminateProcessTree(cmd *exec.Cmd) error {
+	if cmd.Process == nil {
+		return nil
+	}
+	return exec.Command(`taskkill`, `/T`, `/PID`, strconv.Itoa(cmd.Process.Pid)).Run()
+}
+
+// Modules are never killed by a signal on Windows
+//
+func processSignal(state *os.ProcessState) string {
+	return ""
+}
+
+// Returns when a process was created, or an empty string if it cannot be
+// opened
+//
+func processStart(pid int) string {
+	h, err := syscall.OpenProcess(syscall.PROCESS_QUERY_INFORMATION, false, uint32(pid))
+	if err != nil {
+		return ""
+	}
+	defer syscall.CloseHandle(h)
+
+	var creation, exit, kernel, user syscall.Filetime
+	err = syscall.GetProcessTimes(h, &creation, &exit, &kernel, &user)
+	if err != nil {
+		return ""
+	}
+	return strconv.FormatInt(creation.Nanoseconds(), 10)
+}
+
+// Checks if the process which started at start is still running. A PID
+// reused by another process does not match start. start is ignored when
+// empty
+//
+func processExists(pid int, start string) bool {
+	h, err := syscall.OpenProcess(syscall.PROCESS_QUERY_INFORMATION, false, uint32(pid))
+	if err != nil {
+		return false
+	}
+	defer syscall.CloseHandle(h)
+
+	var exitCode uint32
+	err = syscall.GetExitCodeProcess(h, &exitCode)
+	if err != nil || exitCode != stillActive {
+		return false
+	}
+	return start == "" || processStart(pid) == start
+}
+
+// Exit code reported by GetExitCodeProcess for running processes
+const stillActive = 259
@@ -0,0 +1,118 @@
+package tasks
+
+import (
+	"github.com/miky4u2/RAagent/agent/common"
+	"github.com/miky4u2/RAagent/agent/config"
+	"github.com/miky4u2/RAagent/agent/module"
+	"log"
+	"path/filepath"
+	"time"
+)
+
+// Interval between checks of a module left running by a previous agent
+const orphanPollInterval = 5 * time.Second
+
+// Scans the task history for tasks left 'in progress' by a previous agent run.
+// Tasks whose module is gone are marked 'interrupted', tasks whose module is still
+// running are watched and marked 'interrupted' once it exits. Interrupted detached
+// tasks running an idempotent module are queued again.
+// Tasks left 'queued' but missing from the persisted queue are returned, oldest first.
+//
+func recoverTasks(queued map[string]bool) []*queuedTask {
+	var orphanQueued []*queuedTask
+
+	// Queued tasks missing from the queue, oldest first
+	found, _, err := store.List(taskFilter{Status: `queued`, Sort: `asc`}, time.Time{}, time.Time{})
+	if err != nil {
+		log.Println(`Failed scanning task history :`, err)
+	}
+	for _, t := range found {
+		if queued[t.UUID] {
+			continue
+		}
+		task, err := store.Get(t.UUID)
+		if err != nil {
+			continue
+		}
+		orphanQueued = append(orphanQueued, newQueuedTask(&task))
+	}
+
+	// Tasks left running
+	found, _, err = store.List(taskFilter{Status: `in progress`}, time.Time{}, time.Time{})
+	if err != nil {
+		log.Println(`Failed scanning task history :`, err)
+	}
+	for _, t := range found {
+		task, err := store.Get(t.UUID)
+		if err != nil {
+			continue
+		}
+		response := task
+
+		if task.PID > 0 && processExists(task.PID, task.PIDStart) {
+			log.Println(`Task`, task.UUID, `module '`+task.Module+`' is still running with PID`, task.PID, `from a previous agent run, watching it`)
+			go func() {
+				for processExists(response.PID, response.PIDStart) {
+					time.Sleep(orphanPollInterval)
+				}
+				interruptTask(&response)
+			}()
+		} else {
+			go interruptTask(&response)
+		}
+	}
+
+	return orphanQueued
+}
+
+// Marks a task orphaned by a previous agent run as 'interrupted', notifies its
+// notifyURL and queues it again if its module is idempotent
+//
+func interruptTask(response *taskRes) {
+	log.Println(`Task`, response.UUID, `running module '`+response.Module+`' was interrupted by an agent stop`)
+
+	startTime, err := time.ParseInLocation("2006-01-02 15:04:05", response.StartTime, time.Local)
+	if err != nil {
+		startTime = time.Now()
+	}
+	endTime := time.Now()
+	response.Status = `interrupted`
+	response.ErrorMsgs = append(response.ErrorMsgs, `Task interrupted, the agent stopped while the module was running. The module outcome is unknown`)
+	response.EndTime = endTime.Format("2006-01-02 15:04:05")
+	response.Duration = endTime.Sub(startTime).String()
+
+	err = store.Update(response)
+	if err != nil {
+		log.Println(err)
+	}
+
+	reportTask(response, config.Settings.ValidateNotifyTLS)
+
+	// Run the task again if its module can safely be executed twice
+	if response.Mode == `detached` && isIdempotent(response.Module) {
+		log.Println(`Queuing interrupted task`, response.UUID, `again, module '`+response.Module+`' is idempotent`)
+		startTime = time.Now()
+		response.Status = `queued`
+		response.ErrorMsgs = append(response.ErrorMsgs, `Task queued again, the module is idempotent`)
+		response.StartTime = startTime.Format("2006-01-02 15:04:05")
+		response.EndTime = ""
+		response.Duration = ""
+		response.PID = 0
+		response.PIDStart = ""
+		err = store.Update(response)
+		if err != nil {
+			log.Println(err)
+		}
+		enqueueTask(response, filepath.Join(config.AppBasePath, `modules`, response.Module), startTime)
+	}
+}
+
+// Checks if a module is listed in idempotentModules or flagged idempotent in its manifest
+//
+func isIdempotent(name string) bool {
+	if common.Find(config.Settings.IdempotentModules, name) {
+		return true
+	}
+	manifest, err := module.LoadManifest(filepath.Join(config.AppBasePath, `modules`), name)
+	return err == nil && manifest != nil && manifest.Idempotent
+}
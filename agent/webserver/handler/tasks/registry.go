@@ -0,0 +1,166 @@
+package tasks
+
+import (
+	"github.com/miky4u2/RAagent/agent/config"
+	"log"
+	"os/exec"
+	"sync"
+	"time"
+)
+
+// runningTask holds the process of a task being executed. interrupted is
+// set when the task is stopped by an agent shutdown rather than cancelled
+//
+type runningTask struct {
+	cmd         *exec.Cmd
+	module      string
+	output      *outputBuffer
+	cancelledBy string
+	cancelledAt time.Time
+	interrupted bool
+}
+
+// registry of running tasks keyed by task UUID. executing counts task
+// executions from their start until their result is stored and reported,
+// no execution may start once the agent drains
+//
+var registry = struct {
+	sync.Mutex
+	tasks     map[string]*runningTask
+	executing int
+	draining  bool
+}{tasks: make(map[string]*runningTask)}
+
+// RunningCount returns the number of modules currently running
+//
+func RunningCount() int {
+	registry.Lock()
+	defer registry.Unlock()
+	return len(registry.tasks)
+}
+
+// Counts a task execution about to start. Returns false once the agent
+// drains, the task must then not be executed
+//
+func beginExecution() bool {
+	registry.Lock()
+	defer registry.Unlock()
+	if registry.draining {
+		return false
+	}
+	registry.executing++
+	return true
+}
+
+// Counts a task execution as ended
+//
+func endExecution() {
+	registry.Lock()
+	defer registry.Unlock()
+	registry.executing--
+}
+
+// Returns the number of task executions not yet ended
+//
+func executingCount() int {
+	registry.Lock()
+	defer registry.Unlock()
+	return registry.executing
+}
+
+// Adds a started task to the registry
+//
+func registerTask(taskUUID string, module string, cmd *exec.Cmd, output *outputBuffer) {
+	registry.Lock()
+	defer registry.Unlock()
+	registry.tasks[taskUUID] = &runningTask{cmd: cmd, module: module, output: output}
+}
+
+// Removes a task from the registry once its process has exited and
+// returns its registry entry
+//
+func unregisterTask(taskUUID string) *runningTask {
+	registry.Lock()
+	defer registry.Unlock()
+	rt := registry.tasks[taskUUID]
+	delete(registry.tasks, taskUUID)
+	return rt
+}
+
+// Checks if a task is still in the registry
+//
+func isTaskRunning(taskUUID string) bool {
+	registry.Lock()
+	defer registry.Unlock()
+	_, ok := registry.tasks[taskUUID]
+	return ok
+}
+
+// Returns the output of a running task or nil if the task is not running
+//
+func runningTaskOutput(taskUUID string) *outputBuffer {
+	registry.Lock()
+	defer registry.Unlock()
+	rt, ok := registry.tasks[taskUUID]
+	if !ok {
+		return nil
+	}
+	return rt.output
+}
+
+// Cancels a running task. The module is first asked to terminate and is
+// killed if it is still running after the grace period.
+// Returns false if the task is not running or is already being cancelled
+//
+func cancelTask(taskUUID string, cancelledBy string, gracePeriod time.Duration) bool {
+	registry.Lock()
+	rt, ok := registry.tasks[taskUUID]
+	if !ok || rt.cancelledBy != "" {
+		registry.Unlock()
+		return false
+	}
+	rt.cancelledBy = cancelledBy
+	rt.cancelledAt = time.Now()
+	registry.Unlock()
+
+	log.Println(`Cancelling task`, taskUUID, `running module '`+rt.module+`' on request from`, cancelledBy)
+	err := terminateProcessTree(rt.cmd)
+	if err != nil {
+		log.Println(`Failed terminating module '`+rt.module+`' :`, err)
+	}
+
+	go func() {
+		time.Sleep(gracePeriod)
+		if isTaskRunning(taskUUID) {
+			log.Println(`Task`, taskUUID, `still running after grace period, killing module '`+rt.module+`'`)
+			err := killProcessTree(rt.cmd)
+			if err != nil {
+				log.Println(`Failed killing module '`+rt.module+`' :`, err)
+			}
+		}
+	}()
+
+	return true
+}
+
+// Ends a task removed from the queue before it started as cancelled
+//
+func cancelQueuedTask(qt *queuedTask, cancelledBy string) {
+	log.Println(`Cancelling queued task`, qt.response.UUID, `on request from`, cancelledBy)
+
+	endTime := time.Now()
+	response := qt.response
+	response.Status = "cancelled"
+	response.ErrorMsgs = append(response.ErrorMsgs, `Task cancelled by `+cancelledBy)
+	response.CancelledBy = cancelledBy
+	response.CancelledAt = endTime.Format("2006-01-02 15:04:05")
+	response.EndTime = endTime.Format("2006-01-02 15:04:05")
+	response.Duration = endTime.Sub(qt.startTime).String()
+
+	err := store.Update(response)
+	if err != nil {
+		log.Println(err)
+	}
+
+	reportTask(response, config.Settings.ValidateNotifyTLS)
+}
@@ -2,12 +2,10 @@ package tasks
 
 import (
 	"encoding/json"
-	"github.com/miky4u2/RAagent/agent/common"
-	"github.com/miky4u2/RAagent/agent/config"
+	"github.com/miky4u2/RAagent/agent/audit"
+	"github.com/miky4u2/RAagent/agent/auth"
 	"log"
 	"net/http"
-	"os"
-	"path/filepath"
 	"regexp"
 )
 
@@ -26,13 +24,17 @@ type statusRes struct {
 func Status(w http.ResponseWriter, req *http.Request) {
 	var errMsgs []string
 
-	// Check if IP is allowed, abort if not
-	if !common.IsIPAllowed(req, config.Settings.AllowedIPs) {
+	// Check if the request is authorized, abort if not
+	id, ok := auth.Authorize(req, auth.GroupTasks)
+	rec := audit.Record{Event: `tasks/status`, Client: id.String(), IP: id.IP, Result: `unauthorized`}
+	defer func() { audit.Log(rec) }()
+	if !ok {
 		http.Error(w, http.StatusText(403), http.StatusForbidden)
 		return
 	}
 
 	// POST method only
+	rec.Result = `invalid method`
 	if req.Method != "POST" {
 		http.Error(w, http.StatusText(403), http.StatusForbidden)
 		return
@@ -48,6 +50,7 @@ func Status(w http.ResponseWriter, req *http.Request) {
 
 	// Populate the statusReq struct with received json request
 	json.NewDecoder(req.Body).Decode(&statusReq)
+	rec.UUID = statusReq.UUID
 
 	// Validate UUID and Populate task struct with task status
 	task := taskRes{}
@@ -56,24 +59,20 @@ func Status(w http.ResponseWriter, req *http.Request) {
 	if !regexp.MustCompile(`^[a-z0-9\-]+$`).MatchString(statusReq.UUID) {
 		errMsgs = append(errMsgs, `'UUID' incorrect format`)
 	} else {
-		taskFile, err := os.Open(filepath.Join(config.AppBasePath, "tasks", statusReq.UUID+".status"))
-		defer taskFile.Close()
-
-		if err != nil {
+		var err error
+		task, err = store.Get(statusReq.UUID)
+		if err == errTaskNotFound {
 			errMsgs = append(errMsgs, statusReq.UUID+` task does not exist`)
 			log.Println(err)
-		} else {
-			jasonParser := json.NewDecoder(taskFile)
-			err = jasonParser.Decode(&task)
-			if err != nil {
-				errMsgs = append(errMsgs, `Cannot parse data for task `+statusReq.UUID)
-				log.Println(err)
-			}
+		} else if err != nil {
+			errMsgs = append(errMsgs, `Cannot parse data for task `+statusReq.UUID)
+			log.Println(err)
 		}
 	}
 
 	// If we encountered errors, abort and respond with found errors
 	if len(errMsgs) > 0 {
+		rec.Result = `failed`
 		response.Status = `Failed`
 		response.ErrorMsgs = errMsgs
 
@@ -89,6 +88,8 @@ func Status(w http.ResponseWriter, req *http.Request) {
 	// Respond with task status
 	response.Status = `ok`
 	response.Task = task
+	rec.Module = task.Module
+	rec.Result = `ok`
 
 	res, err := json.Marshal(response)
 	if err != nil {
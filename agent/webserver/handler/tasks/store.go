@@ -0,0 +1,151 @@
+package tasks
+
+import (
+	"errors"
+	"github.com/miky4u2/RAagent/agent/config"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// TaskStore persists tasks and keeps the task history
+//
+type TaskStore interface {
+	// Create stores a new task
+	Create(task *taskRes) error
+	// Update stores the current state of a task
+	Update(task *taskRes) error
+	// Get returns a task, or errTaskNotFound
+	Get(taskUUID string) (taskRes, error)
+	// List returns a page of tasks matching filter, without their output, and the total number of matching tasks
+	List(filter taskFilter, from time.Time, to time.Time) ([]taskRes, int, error)
+	// Prune removes tasks which were last updated more than provided days ago
+	Prune(days int) error
+}
+
+// store is the TaskStore selected in config.json
+var store TaskStore
+
+// Error returned by TaskStore.Get for unknown tasks
+var errTaskNotFound = errors.New(`task does not exist`)
+
+// Error returned by TaskStore.Create for existing tasks
+var errTaskExists = errors.New(`task already exists`)
+
+// Opens the TaskStore selected by 'taskStore' in config.json
+//
+func openStore() error {
+	tasksPath := filepath.Join(config.AppBasePath, "tasks")
+
+	var err error
+	switch config.Settings.TaskStore {
+	case `bolt`:
+		store, err = newBoltStore(filepath.Join(tasksPath, "tasks.db"))
+	default:
+		store, err = newFileStore(tasksPath)
+	}
+	return err
+}
+
+// taskFilter holds the criteria used to list tasks.
+// A PageSize of 0 lists all matching tasks
+//
+type taskFilter struct {
+	Status   string `json:"status"`
+	Module   string `json:"module"`
+	Name     string `json:"name"`
+	Mode     string `json:"mode"`
+	RemoteIP string `json:"remoteIP"`
+	From     string `json:"from"`
+	To       string `json:"to"`
+	Sort     string `json:"sort"`
+	Page     int    `json:"page"`
+	PageSize int    `json:"pageSize"`
+}
+
+// Checks if a task matches the filter criteria
+//
+func (f *taskFilter) match(task *taskRes, startTime time.Time, from time.Time, to time.Time) bool {
+	if f.Status != "" && task.Status != f.Status {
+		return false
+	}
+	if f.Module != "" && task.Module != f.Module {
+		return false
+	}
+	if f.Name != "" && !strings.Contains(strings.ToLower(task.Name), strings.ToLower(f.Name)) {
+		return false
+	}
+	if f.Mode != "" && task.Mode != f.Mode {
+		return false
+	}
+	if f.RemoteIP != "" && task.RemoteIP != f.RemoteIP {
+		return false
+	}
+	if !from.IsZero() && startTime.Before(from) {
+		return false
+	}
+	if !to.IsZero() && startTime.After(to) {
+		return false
+	}
+	return true
+}
+
+// Returns the range of a list of n items covered by the filter page
+//
+func (f *taskFilter) pageRange(n int) (int, int) {
+	if f.PageSize == 0 {
+		return 0, n
+	}
+	first := (f.Page - 1) * f.PageSize
+	if first > n {
+		first = n
+	}
+	last := first + f.PageSize
+	if last > n {
+		last = n
+	}
+	return first, last
+}
+
+// Returns a copy of a task without its output, as returned by TaskStore.List
+//
+func withoutOutput(task taskRes) taskRes {
+	task.Output = ""
+	task.Stdout = ""
+	task.Stderr = ""
+	return task
+}
+
+// Parses the start time of a task
+//
+func taskStartTime(task *taskRes) time.Time {
+	startTime, _ := time.ParseInLocation("2006-01-02 15:04:05", task.StartTime, time.Local)
+	return startTime
+}
+
+// Sorts tasks by start time then UUID, in ascending or descending order
+//
+func sortTasks(tasks []taskRes, startTimes []time.Time, order string) {
+	sort.Sort(taskSorter{tasks, startTimes, order == `asc`})
+}
+
+type taskSorter struct {
+	tasks      []taskRes
+	startTimes []time.Time
+	asc        bool
+}
+
+func (s taskSorter) Len() int { return len(s.tasks) }
+
+func (s taskSorter) Swap(i, j int) {
+	s.tasks[i], s.tasks[j] = s.tasks[j], s.tasks[i]
+	s.startTimes[i], s.startTimes[j] = s.startTimes[j], s.startTimes[i]
+}
+
+func (s taskSorter) Less(i, j int) bool {
+	if s.startTimes[i].Equal(s.startTimes[j]) {
+		return (s.tasks[i].UUID < s.tasks[j].UUID) == s.asc
+	}
+	return s.startTimes[i].Before(s.startTimes[j]) == s.asc
+}
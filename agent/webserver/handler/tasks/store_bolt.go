@@ -0,0 +1,227 @@
+package tasks
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"go.etcd.io/bbolt"
+	"time"
+)
+
+// Buckets of the bolt task store
+var (
+	boltTasks     = []byte(`tasks`)
+	boltByStart   = []byte(`byStart`)
+	boltByUpdated = []byte(`byUpdated`)
+)
+
+// Layout of the start time part of byStart keys, sorting chronologically
+const boltStartLayout = "20060102150405"
+
+// boltStore keeps tasks in an embedded bbolt database. Tasks are indexed by
+// start time for listing and by last update time for pruning
+//
+type boltStore struct {
+	db *bbolt.DB
+}
+
+// boltRecord is the value stored for each task
+//
+type boltRecord struct {
+	Updated int64   `json:"updated"`
+	Task    taskRes `json:"task"`
+}
+
+// Opens, or creates, the bolt database at provided path
+//
+func newBoltStore(path string) (*boltStore, error) {
+	db, err := bbolt.Open(path, 0644, &bbolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, err
+	}
+	err = db.Update(func(tx *bbolt.Tx) error {
+		for _, name := range [][]byte{boltTasks, boltByStart, boltByUpdated} {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &boltStore{db: db}, nil
+}
+
+// Create stores a new task
+//
+func (s *boltStore) Create(task *taskRes) error {
+	return s.db.Update(func(tx *bbolt.Tx) error {
+		if tx.Bucket(boltTasks).Get([]byte(task.UUID)) != nil {
+			return errTaskExists
+		}
+		return s.put(tx, task)
+	})
+}
+
+// Update stores the current state of a task
+//
+func (s *boltStore) Update(task *taskRes) error {
+	return s.db.Update(func(tx *bbolt.Tx) error {
+		return s.put(tx, task)
+	})
+}
+
+// Get returns a task
+//
+func (s *boltStore) Get(taskUUID string) (taskRes, error) {
+	record := boltRecord{}
+	err := s.db.View(func(tx *bbolt.Tx) error {
+		value := tx.Bucket(boltTasks).Get([]byte(taskUUID))
+		if value == nil {
+			return errTaskNotFound
+		}
+		return json.Unmarshal(value, &record)
+	})
+	return record.Task, err
+}
+
+// List walks the start time index between from and to
+//
+func (s *boltStore) List(filter taskFilter, from time.Time, to time.Time) ([]taskRes, int, error) {
+	var matches []taskRes
+
+	err := s.db.View(func(tx *bbolt.Tx) error {
+		tasks := tx.Bucket(boltTasks)
+		c := tx.Bucket(boltByStart).Cursor()
+
+		var fromKey, toKey []byte
+		if !from.IsZero() {
+			fromKey = []byte(from.Format(boltStartLayout))
+		}
+		if !to.IsZero() {
+			toKey = []byte(to.Format(boltStartLayout) + "|\xff")
+		}
+
+		// Position the cursor on the first key of the range in the requested order
+		var k []byte
+		asc := filter.Sort == `asc`
+		switch {
+		case asc && fromKey != nil:
+			k, _ = c.Seek(fromKey)
+		case asc:
+			k, _ = c.First()
+		case toKey != nil:
+			k, _ = c.Seek(toKey)
+			if k == nil {
+				k, _ = c.Last()
+			} else if bytes.Compare(k, toKey) > 0 {
+				k, _ = c.Prev()
+			}
+		default:
+			k, _ = c.Last()
+		}
+
+		for ; k != nil; k = s.next(c, asc) {
+			if (fromKey != nil && bytes.Compare(k, fromKey) < 0) || (toKey != nil && bytes.Compare(k, toKey) > 0) {
+				break
+			}
+			record := boltRecord{}
+			value := tasks.Get(k[len(boltStartLayout)+1:])
+			if value == nil || json.Unmarshal(value, &record) != nil {
+				continue
+			}
+			if filter.match(&record.Task, taskStartTime(&record.Task), from, to) {
+				matches = append(matches, withoutOutput(record.Task))
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+
+	first, last := filter.pageRange(len(matches))
+	return append([]taskRes{}, matches[first:last]...), len(matches), nil
+}
+
+// Prune walks the update time index and removes tasks older than provided days
+//
+func (s *boltStore) Prune(days int) error {
+	cutoff := []byte(fmt.Sprintf("%016x", time.Now().Add(-time.Duration(days*24)*time.Hour).UnixNano()))
+
+	return s.db.Update(func(tx *bbolt.Tx) error {
+		var taskUUIDs []string
+		c := tx.Bucket(boltByUpdated).Cursor()
+		for k, _ := c.First(); k != nil && bytes.Compare(k[:16], cutoff) < 0; k, _ = c.Next() {
+			taskUUIDs = append(taskUUIDs, string(k[17:]))
+		}
+		for _, taskUUID := range taskUUIDs {
+			if err := s.delete(tx, taskUUID); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// Stores a task and its index keys, replacing any previous version
+//
+func (s *boltStore) put(tx *bbolt.Tx, task *taskRes) error {
+	if err := s.delete(tx, task.UUID); err != nil {
+		return err
+	}
+	record := boltRecord{Updated: time.Now().UnixNano(), Task: *task}
+	value, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	if err := tx.Bucket(boltTasks).Put([]byte(task.UUID), value); err != nil {
+		return err
+	}
+	if err := tx.Bucket(boltByStart).Put(startKey(task), nil); err != nil {
+		return err
+	}
+	return tx.Bucket(boltByUpdated).Put(updatedKey(record.Updated, task.UUID), nil)
+}
+
+// Removes a task and its index keys
+//
+func (s *boltStore) delete(tx *bbolt.Tx, taskUUID string) error {
+	tasks := tx.Bucket(boltTasks)
+	value := tasks.Get([]byte(taskUUID))
+	if value == nil {
+		return nil
+	}
+	record := boltRecord{}
+	if err := json.Unmarshal(value, &record); err == nil {
+		_ = tx.Bucket(boltByStart).Delete(startKey(&record.Task))
+		_ = tx.Bucket(boltByUpdated).Delete(updatedKey(record.Updated, taskUUID))
+	}
+	return tasks.Delete([]byte(taskUUID))
+}
+
+// Moves the cursor in the requested order
+//
+func (s *boltStore) next(c *bbolt.Cursor, asc bool) []byte {
+	var k []byte
+	if asc {
+		k, _ = c.Next()
+	} else {
+		k, _ = c.Prev()
+	}
+	return k
+}
+
+// Returns the byStart index key of a task
+//
+func startKey(task *taskRes) []byte {
+	return []byte(taskStartTime(task).Format(boltStartLayout) + "|" + task.UUID)
+}
+
+// Returns the byUpdated index key of a task
+//
+func updatedKey(updated int64, taskUUID string) []byte {
+	return []byte(fmt.Sprintf("%016x", updated) + "|" + taskUUID)
+}
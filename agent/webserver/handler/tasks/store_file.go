@@ -0,0 +1,161 @@
+package tasks
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// fileStore keeps each task in a uuid.status json file of the tasks folder,
+// with an index kept in memory so tasks can be listed without reading the files
+//
+type fileStore struct {
+	dir   string
+	mu    sync.RWMutex
+	index map[string]*indexEntry
+}
+
+// indexEntry holds a task without its output, as kept in the index
+//
+type indexEntry struct {
+	task      taskRes
+	startTime time.Time
+	updated   time.Time
+}
+
+// Creates a fileStore and builds its index from the uuid.status files
+//
+func newFileStore(dir string) (*fileStore, error) {
+	s := &fileStore{dir: dir, index: make(map[string]*indexEntry)}
+
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, file := range files {
+		if !strings.HasSuffix(file.Name(), ".status") {
+			continue
+		}
+		task, err := s.Get(strings.TrimSuffix(file.Name(), ".status"))
+		if err != nil {
+			log.Println(`Failed indexing task file`, file.Name(), `:`, err)
+			continue
+		}
+		s.indexTask(&task, file.ModTime())
+	}
+	return s, nil
+}
+
+// Create writes a new uuid.status file
+//
+func (s *fileStore) Create(task *taskRes) error {
+	if _, err := os.Stat(s.taskPath(task.UUID)); err == nil {
+		return errTaskExists
+	}
+	return s.Update(task)
+}
+
+// Update writes a task to its uuid.status file. The file is written to a temporary
+// file first and renamed so that readers never see a partially written task
+//
+func (s *fileStore) Update(task *taskRes) error {
+	fileContent, err := json.MarshalIndent(task, "", " ")
+	if err != nil {
+		return err
+	}
+	taskPath := s.taskPath(task.UUID)
+	err = ioutil.WriteFile(taskPath+".tmp", fileContent, 0644)
+	if err != nil {
+		return err
+	}
+	err = os.Rename(taskPath+".tmp", taskPath)
+	if err != nil {
+		return err
+	}
+	s.indexTask(task, time.Now())
+	return nil
+}
+
+// Get reads a task from its uuid.status file
+//
+func (s *fileStore) Get(taskUUID string) (taskRes, error) {
+	task := taskRes{}
+	taskFile, err := os.Open(s.taskPath(taskUUID))
+	if os.IsNotExist(err) {
+		return task, errTaskNotFound
+	}
+	if err != nil {
+		return task, err
+	}
+	defer taskFile.Close()
+
+	err = json.NewDecoder(taskFile).Decode(&task)
+	return task, err
+}
+
+// List searches the index
+//
+func (s *fileStore) List(filter taskFilter, from time.Time, to time.Time) ([]taskRes, int, error) {
+	var tasks []taskRes
+	var startTimes []time.Time
+
+	s.mu.RLock()
+	for _, entry := range s.index {
+		if filter.match(&entry.task, entry.startTime, from, to) {
+			tasks = append(tasks, entry.task)
+			startTimes = append(startTimes, entry.startTime)
+		}
+	}
+	s.mu.RUnlock()
+
+	sortTasks(tasks, startTimes, filter.Sort)
+
+	first, last := filter.pageRange(len(tasks))
+	return append([]taskRes{}, tasks[first:last]...), len(tasks), nil
+}
+
+// Prune removes uuid.status files older than provided days and drops them from the index
+//
+func (s *fileStore) Prune(days int) error {
+	maxAge := time.Duration(days*24) * time.Hour
+
+	files, err := ioutil.ReadDir(s.dir)
+	if err != nil {
+		return err
+	}
+	for _, file := range files {
+		if file.Mode().IsRegular() && strings.HasSuffix(file.Name(), ".status") && time.Now().Sub(file.ModTime()) > maxAge {
+			_ = os.Remove(filepath.Join(s.dir, file.Name()))
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for taskUUID, entry := range s.index {
+		if time.Now().Sub(entry.updated) > maxAge {
+			delete(s.index, taskUUID)
+		}
+	}
+	return nil
+}
+
+// Adds or updates a task in the index
+//
+func (s *fileStore) indexTask(task *taskRes, updated time.Time) {
+	entry := &indexEntry{task: withoutOutput(*task), startTime: taskStartTime(task), updated: updated}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.index[task.UUID] = entry
+}
+
+// Returns the path of a task uuid.status file
+//
+func (s *fileStore) taskPath(taskUUID string) string {
+	return filepath.Join(s.dir, taskUUID+".status")
+}
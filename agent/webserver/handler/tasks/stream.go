@@ -0,0 +1,142 @@
+package tasks
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"github.com/miky4u2/RAagent/agent/auth"
+	"net/http"
+	"regexp"
+	"strconv"
+	"time"
+)
+
+// Interval between keep alive comments sent to idle streams
+const streamKeepAlive = 15 * time.Second
+
+// Interval between checks for a task which has not started yet
+const streamStartPoll = 500 * time.Millisecond
+
+// Stream HTTP handler function. Streams the output of a task as Server-Sent Events.
+// The output already produced is replayed first, then new output is sent as the module
+// produces it until the task completes. Each 'output' event carries a base64 encoded chunk
+// and its id is the output offset, allowing clients to resume with Last-Event-ID.
+// A final 'end' event carries the task status.
+//
+func Stream(w http.ResponseWriter, req *http.Request) {
+
+	// Check if the request is authorized, abort if not
+	_, ok := auth.Authorize(req, auth.GroupTasks)
+	if !ok {
+		http.Error(w, http.StatusText(403), http.StatusForbidden)
+		return
+	}
+
+	// GET method only
+	if req.Method != "GET" {
+		http.Error(w, http.StatusText(403), http.StatusForbidden)
+		return
+	}
+
+	taskUUID := req.URL.Query().Get("uuid")
+	if !regexp.MustCompile(`^[a-z0-9\-]+$`).MatchString(taskUUID) {
+		http.Error(w, `'UUID' incorrect format`, http.StatusBadRequest)
+		return
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, `Streaming not supported`, http.StatusInternalServerError)
+		return
+	}
+
+	// Resume from the last received offset if provided
+	offset, _ := strconv.Atoi(req.Header.Get("Last-Event-ID"))
+	if offset < 0 {
+		offset = 0
+	}
+
+	// Wait for the task to start if it has not yet
+	var output *outputBuffer
+	var task taskRes
+	for {
+		output = runningTaskOutput(taskUUID)
+		if output != nil {
+			break
+		}
+		var err error
+		task, err = store.Get(taskUUID)
+		if err != nil {
+			http.Error(w, taskUUID+` task does not exist`, http.StatusNotFound)
+			return
+		}
+		if task.Status != `in progress` && task.Status != `queued` {
+			break
+		}
+		select {
+		case <-req.Context().Done():
+			return
+		case <-time.After(streamStartPoll):
+		}
+	}
+
+	// Prepare response header
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(200)
+
+	// Task already completed, replay its stored output
+	if output == nil {
+		data, _ := base64.StdEncoding.DecodeString(task.Output)
+		if offset < len(data) {
+			writeEvent(w, `output`, strconv.Itoa(len(data)), base64.StdEncoding.EncodeToString(data[offset:]))
+		}
+		writeEndEvent(w, task.Status)
+		flusher.Flush()
+		return
+	}
+
+	// Follow the running task output
+	keepAlive := time.NewTicker(streamKeepAlive)
+	defer keepAlive.Stop()
+	for {
+		data, notify, closed, status := output.ReadFrom(offset)
+		if len(data) > 0 {
+			offset += len(data)
+			writeEvent(w, `output`, strconv.Itoa(offset), base64.StdEncoding.EncodeToString(data))
+		}
+		if closed {
+			writeEndEvent(w, status)
+			flusher.Flush()
+			return
+		}
+		flusher.Flush()
+
+		select {
+		case <-req.Context().Done():
+			return
+		case <-keepAlive.C:
+			fmt.Fprint(w, ": keep-alive\n\n")
+		case <-notify:
+		}
+	}
+}
+
+// Writes a single Server-Sent Event
+//
+func writeEvent(w http.ResponseWriter, event string, id string, data string) {
+	if id != "" {
+		fmt.Fprintf(w, "id: %s\n", id)
+	}
+	fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event, data)
+}
+
+// Writes the final event of a stream
+//
+func writeEndEvent(w http.ResponseWriter, status string) {
+	data, _ := json.Marshal(struct {
+		Status string `json:"status"`
+	}{status})
+	writeEvent(w, `end`, ``, string(data))
+}
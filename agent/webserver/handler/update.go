@@ -2,38 +2,93 @@ package handler
 
 import (
 	"archive/tar"
+	"bytes"
 	"compress/gzip"
-	"crypto/tls"
 	"encoding/json"
 	"errors"
+	"github.com/miky4u2/RAagent/agent/audit"
+	"github.com/miky4u2/RAagent/agent/auth"
 	"github.com/miky4u2/RAagent/agent/common"
 	"github.com/miky4u2/RAagent/agent/config"
+	"github.com/miky4u2/RAagent/agent/lifecycle"
 	"io"
 	"log"
 	"net/http"
 	"os"
+	"path"
 	"path/filepath"
 	"strconv"
 	"strings"
-	"time"
 )
 
+// Size limits of update archives
+const (
+	updateMaxArchiveSize = 512 * 1024 * 1024
+	updateMaxFileSize    = 256 * 1024 * 1024
+	updateMaxTotalSize   = 1024 * 1024 * 1024
+	updateMaxEntries     = 10000
+)
+
+// updateLayout declares the files an update archive may hold, relative to the
+// agent base folder, and for which update types they are installed. A path
+// ending with / covers all the files below that folder, a path with a * is
+// matched as a pattern
+//
+var updateLayout = []struct {
+	path  string
+	types []string
+}{
+	{`bin/agent`, []string{`full`}},
+	{`bin/agent.exe`, []string{`full`}},
+	{`conf/cert.pem`, []string{`full`}},
+	{`conf/key.pem`, []string{`full`}},
+	{`conf/config.json`, []string{`full`}},
+	{`conf/*.pem`, []string{`full`}},
+	{`modules/`, []string{`full`, `modules`, `sync`}},
+}
+
+// Held while an update runs, updates share the same download and staging
+// paths and must not run concurrently
+//
+var updating = make(chan struct{}, 1)
+
 // Update HTTP handler function
 //
 func Update(w http.ResponseWriter, req *http.Request) {
 
-	// Check if IP is allowed, abort if not. (Must be server IP)
-	if !common.IsIPAllowed(req, config.Settings.ServerIP) {
+	// Check if the request is authorized, abort if not. (Must be the server)
+	id, ok := auth.Authorize(req, auth.GroupServer)
+	rec := audit.Record{Event: `update`, Client: id.String(), IP: id.IP, Result: `unauthorized`}
+	defer func() { audit.Log(rec) }()
+	if !ok {
 		http.Error(w, http.StatusText(403), http.StatusForbidden)
 		return
 	}
 
 	// POST method only
+	rec.Result = `invalid method`
 	if req.Method != "POST" {
 		http.Error(w, http.StatusText(403), http.StatusForbidden)
 		return
 	}
 
+	// No update while the agent drains before stopping
+	if lifecycle.Draining() {
+		rec.Result = `draining`
+		lifecycle.Refuse(w)
+		return
+	}
+
+	// One update at a time, others are refused with a 409 status
+	select {
+	case updating <- struct{}{}:
+		defer func() { <-updating }()
+	default:
+		rec.Result = `update in progress`
+		http.Error(w, `update already in progress`, http.StatusConflict)
+		return
+	}
+
 	// Prepare response header
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(200)
@@ -50,9 +105,11 @@ func Update(w http.ResponseWriter, req *http.Request) {
 
 	// Populate the updateReq struct with received json request
 	json.NewDecoder(req.Body).Decode(&updateReq)
+	rec.Type = updateReq.Type
+	rec.Result = `failed`
 
 	// If action is invalid, abbort now
-	if updateReq.Type != `full` && updateReq.Type != `modules` {
+	if updateReq.Type != `full` && updateReq.Type != `modules` && updateReq.Type != `sync` {
 		log.Println(`Received incorrect update type`)
 		updateRes.Status = "failed"
 		updateRes.ErrorMsgs = append(updateRes.ErrorMsgs, `Invalid update type`)
@@ -65,9 +122,26 @@ func Update(w http.ResponseWriter, req *http.Request) {
 		return
 	}
 
-	// Pull tar.gz update file from server
+	// Pull tar.gz update file from server. For sync updates, the server receives
+	// the module inventory and only sends the changes
+	var err error
 	archivePath := filepath.Join(config.AppBasePath, `temp`, `update.tar.gz`)
-	err := downloadUpdateFile(config.Settings.ServerURL, config.Settings.AgentID, archivePath, config.Settings.ValidateServerTLS)
+	if updateReq.Type == `sync` {
+		err = downloadSyncFile(config.Settings.ServerURL, config.Settings.AgentID, archivePath)
+	} else {
+		err = downloadUpdateFile(config.Settings.ServerURL, config.Settings.AgentID, archivePath)
+	}
+	if err == errNoChanges {
+		log.Println(`Modules are up to date`)
+		updateRes.Status = "done"
+		rec.Result = `done`
+		res, err := json.Marshal(updateRes)
+		if err != nil {
+			log.Println(err)
+		}
+		w.Write(res)
+		return
+	}
 	if err != nil {
 		log.Println(`Error downloading update archive from server -`, err)
 		updateRes.Status = "failed"
@@ -80,12 +154,44 @@ func Update(w http.ResponseWriter, req *http.Request) {
 		return
 	}
 
-	// Delete all existing modules before updating
-	modulesPath := filepath.Join(config.AppBasePath, `modules`)
-	common.DeleteOldFiles(modulesPath, 0)
+	// Verify the archive signature and checksums before anything is extracted
+	manifest, err := verifyUpdate(archivePath, updateReq.Type)
+	if err != nil {
+		log.Println(`Rejected update archive -`, err)
+		_ = os.Remove(archivePath)
+		updateRes.Status = "failed"
+		updateRes.ErrorMsgs = append(updateRes.ErrorMsgs, `Update archive verification failed`)
+		rec.Result = `rejected`
+		res, err := json.Marshal(updateRes)
+		if err != nil {
+			log.Println(err)
+		}
+		w.Write(res)
+		return
+	}
+
+	// Extract the archive into a staging folder, validate the staged files and
+	// swap them in place of the current ones, keeping the previous generation
+	stagePath := filepath.Join(config.AppBasePath, `temp`, `update`)
+	err = updateFiles(archivePath, stagePath, updateReq.Type, manifest.Remove)
+	if err == nil {
+		err = validateStagedUpdate(stagePath, updateReq.Type)
+	}
+	if err == nil {
+		err = applyStagedUpdate(stagePath, updateReq.Type)
+	}
+	if err == nil {
+		// The archive cannot be applied again
+		serialErr := saveUpdateSerial(manifest.Serial)
+		if serialErr != nil {
+			log.Println(`Failed recording update serial :`, serialErr)
+		}
+	}
+
+	// Remove tar.gz archive and staging folder, ignore error in case they are missing
+	_ = os.Remove(archivePath)
+	_ = os.RemoveAll(stagePath)
 
-	// Update files
-	err = updateFiles(archivePath, updateReq.Type)
 	if err != nil {
 		log.Println(`Error updating files -`, err)
 		updateRes.Status = "failed"
@@ -98,11 +204,9 @@ func Update(w http.ResponseWriter, req *http.Request) {
 		return
 	}
 
-	// Remove tar.gz archive, ignore error in case the archive is missing
-	_ = os.Remove(archivePath)
-
 	// Send response
 	updateRes.Status = "done"
+	rec.Result = `done`
 	res, err := json.Marshal(updateRes)
 	if err != nil {
 		log.Println(err)
@@ -110,32 +214,39 @@ func Update(w http.ResponseWriter, req *http.Request) {
 	w.Write(res)
 	log.Println(`Updates were successfully applied`)
 
-	// if full update was requested, exit now and hope for the best. The startagent should take over
-	// by updating the binary with the update's binary and restart
+	// if full update was requested, drain and stop once running tasks end. The startagent takes over by updating
+	// the binary with the update's binary and restarting, or rolling back if the agent does not come up healthy
 	if updateReq.Type == `full` {
 		log.Println(`Restarting to finish executable update...`)
-		go func() { time.Sleep(1 * time.Second); os.Exit(0) }()
+		lifecycle.Stop(false)
 	}
 
 }
 
 // Downloads update tar.gz file from server
 //
-func downloadUpdateFile(serverURL string, agentID string, destPath string, validateServerTLS bool) error {
+func downloadUpdateFile(serverURL string, agentID string, destPath string) error {
 	// Send download request to server to pull tar.gz archive file
 	url := serverURL + `/api/download`
 	downloadReqString := `{"agentID":"` + agentID + `","archive":"update"}`
 
-	downloadReq, err := http.NewRequest("POST", url, strings.NewReader(downloadReqString))
+	return downloadArchive(url, []byte(downloadReqString), destPath)
+}
+
+// Posts a request to the server and saves the tar.gz archive received.
+// Returns errNoChanges if the server answers without content
+//
+func downloadArchive(url string, reqBody []byte, destPath string) error {
+	downloadReq, err := http.NewRequest("POST", url, bytes.NewReader(reqBody))
 	if err != nil {
 		return err
 	}
 
 	downloadReq.Header.Set("Content-Type", "application/json")
 
-	// Do we validate the server TLS certificate? true/false
+	// Verify the server TLS certificate as configured by validateServerTLS and serverCAFile
 	tr := &http.Transport{
-		TLSClientConfig: &tls.Config{InsecureSkipVerify: !validateServerTLS},
+		TLSClientConfig: common.ServerTLSConfig(),
 	}
 	client := &http.Client{Transport: tr}
 	downloadRes, err := client.Do(downloadReq)
@@ -145,6 +256,9 @@ func downloadUpdateFile(serverURL string, agentID string, destPath string, valid
 	defer downloadRes.Body.Close()
 
 	// Check that we receive a status code 200
+	if downloadRes.StatusCode == http.StatusNoContent {
+		return errNoChanges
+	}
 	if downloadRes.StatusCode != http.StatusOK {
 		return errors.New(`Received incorrect status code while downloading update from server: ` + strconv.Itoa(downloadRes.StatusCode))
 	}
@@ -156,17 +270,30 @@ func downloadUpdateFile(serverURL string, agentID string, destPath string, valid
 	}
 	defer out.Close()
 
-	_, err = io.Copy(out, downloadRes.Body)
+	size, err := io.Copy(out, io.LimitReader(downloadRes.Body, updateMaxArchiveSize+1))
 	if err != nil {
 		return err
 	}
+	if size > updateMaxArchiveSize {
+		return errors.New(`update archive is larger than ` + strconv.Itoa(updateMaxArchiveSize) + ` bytes`)
+	}
 
 	return err
 }
 
-// Extracts files from archive and update local files
+// Extracts files from archive into the staging folder. Only files declared in
+// updateLayout for the update type are extracted, at the same path
 //
-func updateFiles(archivePath string, updateType string) error {
+func updateFiles(archivePath string, stagePath string, updateType string, removed []string) error {
+
+	// Start with an empty staging folder
+	_ = os.RemoveAll(stagePath)
+	for _, dir := range []string{`bin`, `conf`, `modules`} {
+		err := os.MkdirAll(filepath.Join(stagePath, dir), 0700)
+		if err != nil {
+			return err
+		}
+	}
 
 	// Unpack tar.gz update file
 	f, err := os.Open(archivePath)
@@ -181,6 +308,10 @@ func updateFiles(archivePath string, updateType string) error {
 
 	tarReader := tar.NewReader(gzf)
 
+	var totalSize int64
+	var entries int
+	extracted := make(map[string]bool)
+
 	// Loop through archive paths
 	for true {
 		header, err := tarReader.Next()
@@ -193,82 +324,123 @@ func updateFiles(archivePath string, updateType string) error {
 			return err
 		}
 
-		name := header.Name
-
-		// Only process regular files
-		if header.Typeflag == tar.TypeReg {
-
-			var destpath string
-			var mode int
+		entries++
+		if entries > updateMaxEntries {
+			return errors.New(`archive holds more than ` + strconv.Itoa(updateMaxEntries) + ` entries`)
+		}
 
-			// Only copy those files for full updates
-			if updateType == `full` {
-				if strings.Contains(name, `cert.pem`) {
-					log.Println(`Updating TLS certiticate`)
-					destpath = filepath.Join(config.AppBasePath, `conf`, `cert.pem`)
-					mode = int(0700)
-					err = fileCopy(tarReader, destpath, os.FileMode(mode))
-					if err != nil {
-						return err
-					}
-				}
-				if strings.Contains(name, `key.pem`) {
-					log.Println(`Updating TLS key`)
-					destpath = filepath.Join(config.AppBasePath, `conf`, `key.pem`)
-					mode = int(0700)
-					err = fileCopy(tarReader, destpath, os.FileMode(mode))
-					if err != nil {
-						return err
-					}
-				}
-				if strings.Contains(name, `config.json`) {
-					log.Println(`Updating config.json`)
-					destpath = filepath.Join(config.AppBasePath, `conf`, `config.json`)
-					mode = int(0700)
-					err = fileCopy(tarReader, destpath, os.FileMode(mode))
-					if err != nil {
-						return err
-					}
-				}
-				if strings.Contains(name, `bin/agent.exe`) {
-					log.Println(`Preparing executable update`)
-					destpath = filepath.Join(config.AppBasePath, `bin`, `update_agent.exe`)
-					mode = int(0700)
-					err = fileCopy(tarReader, destpath, os.FileMode(mode))
-					if err != nil {
-						return err
-					}
-				} else if strings.Contains(name, `bin/agent`) {
-					log.Println(`Preparing executable update`)
-					destpath = filepath.Join(config.AppBasePath, `bin`, `update_agent`)
-					mode = int(0700)
-					err = fileCopy(tarReader, destpath, os.FileMode(mode))
-					if err != nil {
-						return err
-					}
-				}
-			}
+		name, err := archiveEntryPath(header.Name)
+		if err != nil {
+			return err
+		}
+		if name == updateManifestName || name == updateSignatureName {
+			continue
+		}
 
-			// Copy modules
-			if strings.Contains(name, `modules/`) {
-				moduleName := filepath.Base(name)
-				log.Println(`Updating module:`, moduleName)
-				destpath = filepath.Join(config.AppBasePath, `modules`, moduleName)
-				mode = int(0700)
-				err = fileCopy(tarReader, destpath, os.FileMode(mode))
+		// Only folders and regular files are accepted, links could point outside of the agent folders
+		switch header.Typeflag {
+		case tar.TypeDir:
+			if strings.HasPrefix(name+`/`, `modules/`) {
+				err = os.MkdirAll(filepath.Join(stagePath, filepath.FromSlash(name)), os.FileMode(header.Mode).Perm()|0700)
 				if err != nil {
 					return err
 				}
 			}
+			continue
+		case tar.TypeReg:
+		default:
+			return errors.New(`'` + header.Name + `' is not a regular file or folder`)
+		}
+
+		types, found := layoutTypes(name)
+		if !found {
+			return errors.New(`'` + name + `' is not part of the update layout`)
+		}
+		if !common.Find(types, updateType) {
+			continue
+		}
+		if strings.HasPrefix(name, `modules/`) && isProtectedModule(name) {
+			log.Println(`Skipping protected module file:`, name)
+			continue
+		}
+		if extracted[name] {
+			return errors.New(`archive holds '` + name + `' more than once`)
+		}
+		extracted[name] = true
 
+		// Enforce size limits before writing anything
+		totalSize += header.Size
+		if header.Size > updateMaxFileSize {
+			return errors.New(`'` + name + `' is larger than ` + strconv.Itoa(updateMaxFileSize) + ` bytes`)
 		}
+		if totalSize > updateMaxTotalSize {
+			return errors.New(`archive files are larger than ` + strconv.Itoa(updateMaxTotalSize) + ` bytes in total`)
+		}
+
+		// Keep the permissions from the archive, the agent must still be able to replace the file
+		mode := os.FileMode(header.Mode).Perm() | 0600
 
+		log.Println(`Staging`, name)
+		destPath := filepath.Join(stagePath, filepath.FromSlash(name))
+		err = os.MkdirAll(filepath.Dir(destPath), 0700)
+		if err != nil {
+			return err
+		}
+		err = fileCopy(tarReader, destPath, mode)
+		if err != nil {
+			return err
+		}
+	}
+
+	// Complete the staged modules folder with the current files which are kept
+	err = stageCurrentModules(stagePath, updateType, removed)
+	if err != nil {
+		return err
+	}
+
+	// Complete the staged conf folder with the current files which are not updated
+	if updateType == `full` {
+		err = copyMissingFiles(filepath.Join(config.AppBasePath, `conf`), filepath.Join(stagePath, `conf`))
 	}
 
 	return err
 
 }
 
+// Checks the name of an archive entry and returns it without leading ./ and
+// trailing /. Absolute names and names escaping the archive root are rejected
+//
+func archiveEntryPath(name string) (string, error) {
+	cleanName := strings.TrimSuffix(strings.TrimPrefix(name, `./`), `/`)
+	if cleanName == "" || strings.Contains(cleanName, `\`) || strings.Contains(cleanName, `:`) || path.IsAbs(cleanName) {
+		return "", errors.New(`'` + name + `' is not a valid relative path`)
+	}
+	for _, element := range strings.Split(cleanName, `/`) {
+		if element == `..` {
+			return "", errors.New(`'` + name + `' must not contain '..'`)
+		}
+	}
+	if path.Clean(cleanName) != cleanName {
+		return "", errors.New(`'` + name + `' is not a clean path`)
+	}
+	return cleanName, nil
+}
+
+// Returns the update types for which a file of the update layout is extracted.
+// Returns false if the file is not part of the layout
+//
+func layoutTypes(name string) ([]string, bool) {
+	for _, entry := range updateLayout {
+		if name == entry.path || (strings.HasSuffix(entry.path, `/`) && strings.HasPrefix(name, entry.path)) {
+			return entry.types, true
+		}
+		if matched, _ := path.Match(entry.path, name); strings.Contains(entry.path, `*`) && matched {
+			return entry.types, true
+		}
+	}
+	return nil, false
+}
+
 // Copy a file from archive to final destination
 //
 func fileCopy(tarReader *tar.Reader, destPath string, perms os.FileMode) error {
@@ -278,12 +450,17 @@ func fileCopy(tarReader *tar.Reader, destPath string, perms os.FileMode) error {
 		perms,
 	)
 
+	if err != nil {
+		return err
+	}
+
 	defer file.Close()
 
+	_, err = io.Copy(file, tarReader)
 	if err != nil {
 		return err
 	}
-	_, err = io.Copy(file, tarReader)
 
-	return err
+	// Apply permissions to existing files too
+	return file.Chmod(perms)
 }
@@ -0,0 +1,185 @@
+package handler
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"github.com/miky4u2/RAagent/agent/config"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestArchiveEntryPath(t *testing.T) {
+	tests := []struct {
+		name string
+		want string
+		ok   bool
+	}{
+		{`modules/hello`, `modules/hello`, true},
+		{`./modules/hello`, `modules/hello`, true},
+		{`modules/lib/`, `modules/lib`, true},
+		{`conf/config.json`, `conf/config.json`, true},
+		{`../x`, ``, false},
+		{`modules/../../x`, ``, false},
+		{`/abs`, ``, false},
+		{`/etc/passwd`, ``, false},
+		{`a\..\b`, ``, false},
+		{`modules\hello`, ``, false},
+		{`C:x`, ``, false},
+		{`C:/x`, ``, false},
+		{`modules//hello`, ``, false},
+		{`modules/./hello`, ``, false},
+		{``, ``, false},
+		{`./`, ``, false},
+	}
+	for _, test := range tests {
+		got, err := archiveEntryPath(test.name)
+		if test.ok && (err != nil || got != test.want) {
+			t.Errorf(`archiveEntryPath(%q) = %q, %v, want %q`, test.name, got, err, test.want)
+		}
+		if !test.ok && err == nil {
+			t.Errorf(`archiveEntryPath(%q) = %q, want an error`, test.name, got)
+		}
+	}
+}
+
+// archiveEntry is an entry of a test update archive. Only the header is
+// written when body is shorter than size
+//
+type archiveEntry struct {
+	name     string
+	typeflag byte
+	body     string
+	size     int64
+	linkname string
+}
+
+// Writes a tar.gz archive holding entries
+//
+func writeArchive(t *testing.T, archivePath string, entries []archiveEntry) {
+	t.Helper()
+	f, err := os.Create(archivePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	gzw := gzip.NewWriter(f)
+	defer gzw.Close()
+	tw := tar.NewWriter(gzw)
+
+	for _, entry := range entries {
+		size := entry.size
+		if size == 0 && entry.typeflag == tar.TypeReg {
+			size = int64(len(entry.body))
+		}
+		err = tw.WriteHeader(&tar.Header{Name: entry.name, Typeflag: entry.typeflag, Size: size, Linkname: entry.linkname, Mode: 0755})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if int64(len(entry.body)) < size {
+			// Truncated archive, the tar writer is not closed
+			tw.Flush()
+			return
+		}
+		_, err = tw.Write([]byte(entry.body))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = tw.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Sets up an agent base folder with a module and a config file
+//
+func setupBase(t *testing.T) string {
+	t.Helper()
+	basePath, err := ioutil.TempDir("", "raagent")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(basePath) })
+	for _, dir := range []string{`modules`, `conf`, `temp`} {
+		err = os.Mkdir(filepath.Join(basePath, dir), 0755)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = ioutil.WriteFile(filepath.Join(basePath, `modules`, `current`), []byte("current\n"), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(filepath.Join(basePath, `conf`, `config.json`), []byte("{}\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config.AppBasePath = basePath
+	return basePath
+}
+
+func TestUpdateFiles(t *testing.T) {
+	tests := []struct {
+		name       string
+		updateType string
+		entry      archiveEntry
+		err        string
+		staged     string
+		skipped    bool
+	}{
+		{`module`, `modules`, archiveEntry{name: `modules/hello`, typeflag: tar.TypeReg, body: "hello\n"}, ``, `modules/hello`, false},
+		{`module subfolder`, `sync`, archiveEntry{name: `./modules/lib/common.sh`, typeflag: tar.TypeReg, body: "lib\n"}, ``, `modules/lib/common.sh`, false},
+		{`config`, `full`, archiveEntry{name: `conf/config.json`, typeflag: tar.TypeReg, body: "{\"agentID\": \"new\"}\n"}, ``, `conf/config.json`, false},
+		{`CA bundle`, `full`, archiveEntry{name: `conf/ca.pem`, typeflag: tar.TypeReg, body: "pem\n"}, ``, `conf/ca.pem`, false},
+		{`config skipped for modules update`, `modules`, archiveEntry{name: `conf/config.json`, typeflag: tar.TypeReg, body: "{}\n"}, ``, `conf/config.json`, true},
+		{`parent path`, `modules`, archiveEntry{name: `../x`, typeflag: tar.TypeReg, body: "x"}, `must not contain '..'`, ``, false},
+		{`parent in module path`, `modules`, archiveEntry{name: `modules/../../x`, typeflag: tar.TypeReg, body: "x"}, `must not contain '..'`, ``, false},
+		{`absolute path`, `modules`, archiveEntry{name: `/abs`, typeflag: tar.TypeReg, body: "x"}, `not a valid relative path`, ``, false},
+		{`backslashes`, `modules`, archiveEntry{name: `a\..\b`, typeflag: tar.TypeReg, body: "x"}, `not a valid relative path`, ``, false},
+		{`drive letter`, `modules`, archiveEntry{name: `C:x`, typeflag: tar.TypeReg, body: "x"}, `not a valid relative path`, ``, false},
+		{`symlink`, `modules`, archiveEntry{name: `modules/link`, typeflag: tar.TypeSymlink, linkname: `/etc/passwd`}, `not a regular file or folder`, ``, false},
+		{`hardlink`, `modules`, archiveEntry{name: `modules/link`, typeflag: tar.TypeLink, linkname: `modules/current`}, `not a regular file or folder`, ``, false},
+		{`device`, `modules`, archiveEntry{name: `modules/dev`, typeflag: tar.TypeChar}, `not a regular file or folder`, ``, false},
+		{`outside layout`, `full`, archiveEntry{name: `bin/other`, typeflag: tar.TypeReg, body: "x"}, `not part of the update layout`, ``, false},
+		{`oversized`, `modules`, archiveEntry{name: `modules/big`, typeflag: tar.TypeReg, size: updateMaxFileSize + 1}, `is larger than`, ``, false},
+	}
+
+	for _, test := range tests {
+		basePath := setupBase(t)
+		archivePath := filepath.Join(basePath, `temp`, `update.tar.gz`)
+		stagePath := filepath.Join(basePath, `temp`, `update`)
+		writeArchive(t, archivePath, []archiveEntry{test.entry})
+
+		err := updateFiles(archivePath, stagePath, test.updateType, nil)
+		if test.err != `` {
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Errorf(`%s: got error %v, want %q`, test.name, err, test.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf(`%s: unexpected error %v`, test.name, err)
+			continue
+		}
+		if test.skipped {
+			if fileExists(filepath.Join(stagePath, filepath.FromSlash(test.staged))) {
+				t.Errorf(`%s: %s was extracted`, test.name, test.staged)
+			}
+			continue
+		}
+		if test.staged != `` {
+			content, err := ioutil.ReadFile(filepath.Join(stagePath, filepath.FromSlash(test.staged)))
+			if err != nil || string(content) != test.entry.body {
+				t.Errorf(`%s: staged %s holds %q, %v, want %q`, test.name, test.staged, content, err, test.entry.body)
+			}
+		}
+	}
+}
+
+func fileExists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
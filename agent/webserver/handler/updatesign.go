@@ -0,0 +1,241 @@
+package handler
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"github.com/miky4u2/RAagent/agent/common"
+	"github.com/miky4u2/RAagent/agent/config"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// Names of the signed manifest and of its detached signature in update archives
+const (
+	updateManifestName  = `manifest.json`
+	updateSignatureName = `manifest.sig`
+)
+
+// File of the conf folder holding the serial of the last applied update
+const updateSerialName = `update_serial`
+
+// Maximum size of the manifest and of its signature
+const (
+	updateManifestMaxSize  = 1024 * 1024
+	updateSignatureMaxSize = 1024
+)
+
+// updateManifest lists the files of an update archive with their SHA-256,
+// and for sync updates the module files to remove. A signed manifest is
+// bound to an agent ID (or * for any agent), an update type and the agent
+// version it was built for. Serial increases with every signed archive
+//
+type updateManifest struct {
+	AgentID string               `json:"agentID"`
+	Type    string               `json:"type"`
+	Version string               `json:"version"`
+	Serial  int64                `json:"serial"`
+	Files   []updateManifestFile `json:"files"`
+	Remove  []string             `json:"remove"`
+}
+
+type updateManifestFile struct {
+	Path   string `json:"path"`
+	SHA256 string `json:"sha256"`
+}
+
+// Verifies an update archive against the public key pinned in config.json,
+// and that its manifest was signed for this agent, for updateType and for
+// this agent version or a newer one, with a serial greater than the last
+// applied one, so a signed archive cannot be replayed to another agent, to
+// this one again or to downgrade it. Updates are refused when no
+// key is configured. Returns the archive manifest
+//
+func verifyUpdate(archivePath string, updateType string) (*updateManifest, error) {
+	if config.Settings.UpdatePublicKey == "" {
+		return nil, errors.New(`no updatePublicKey configured, updates are disabled`)
+	}
+
+	publicKey, err := base64.StdEncoding.DecodeString(config.Settings.UpdatePublicKey)
+	if err != nil {
+		return nil, err
+	}
+	manifest, err := verifyUpdateArchive(archivePath, ed25519.PublicKey(publicKey))
+	if err != nil {
+		return nil, err
+	}
+	return manifest, checkUpdateTarget(manifest, updateType)
+}
+
+// Checks the agent ID, update type, version and serial a manifest was
+// signed for
+//
+func checkUpdateTarget(manifest *updateManifest, updateType string) error {
+	if manifest.AgentID != config.Settings.AgentID && manifest.AgentID != `*` {
+		return errors.New(updateManifestName + ` is signed for agent '` + manifest.AgentID + `'`)
+	}
+	if manifest.Type != updateType {
+		return errors.New(updateManifestName + ` is signed for a '` + manifest.Type + `' update, not '` + updateType + `'`)
+	}
+	if manifest.Version == "" {
+		return errors.New(updateManifestName + ` has no version`)
+	}
+	cmp, err := common.CompareVersions(manifest.Version, config.Version)
+	if err != nil {
+		return errors.New(updateManifestName + ` version : ` + err.Error())
+	}
+	if cmp < 0 {
+		return errors.New(updateManifestName + ` version ` + manifest.Version + ` is older than the installed version ` + config.Version)
+	}
+	if manifest.Serial < 1 {
+		return errors.New(updateManifestName + ` has no serial`)
+	}
+	lastSerial, err := lastUpdateSerial()
+	if err != nil {
+		return err
+	}
+	if manifest.Serial <= lastSerial {
+		return errors.New(updateManifestName + ` serial ` + strconv.FormatInt(manifest.Serial, 10) +
+			` is not greater than the last applied serial ` + strconv.FormatInt(lastSerial, 10))
+	}
+	return nil
+}
+
+// Returns the serial of the last applied update, 0 if none was applied
+//
+func lastUpdateSerial() (int64, error) {
+	data, err := ioutil.ReadFile(filepath.Join(config.AppBasePath, `conf`, updateSerialName))
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	serial, err := strconv.ParseInt(strings.TrimSpace(string(data)), 10, 64)
+	if err != nil {
+		return 0, errors.New(updateSerialName + ` is invalid : ` + err.Error())
+	}
+	return serial, nil
+}
+
+// Records the serial of an applied update
+//
+func saveUpdateSerial(serial int64) error {
+	serialPath := filepath.Join(config.AppBasePath, `conf`, updateSerialName)
+	err := ioutil.WriteFile(serialPath+`.tmp`, []byte(strconv.FormatInt(serial, 10)+"\n"), 0644)
+	if err != nil {
+		return err
+	}
+	return os.Rename(serialPath+`.tmp`, serialPath)
+}
+
+// Checks that an update archive carries a manifest signed with provided key,
+// and that the archive holds exactly the files listed in the manifest with
+// matching SHA-256. Returns the verified manifest
+//
+func verifyUpdateArchive(archivePath string, publicKey ed25519.PublicKey) (*updateManifest, error) {
+	f, err := os.Open(archivePath)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	gzf, err := gzip.NewReader(f)
+	if err != nil {
+		return nil, err
+	}
+
+	tarReader := tar.NewReader(gzf)
+
+	var manifestData, signatureData []byte
+	hashes := make(map[string]string)
+
+	// Read the manifest and signature, and hash every other regular file
+	for {
+		header, err := tarReader.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		name := strings.TrimPrefix(header.Name, `./`)
+		if header.Typeflag != tar.TypeReg {
+			continue
+		}
+
+		switch name {
+		case updateManifestName:
+			manifestData, err = ioutil.ReadAll(io.LimitReader(tarReader, updateManifestMaxSize+1))
+			if err == nil && len(manifestData) > updateManifestMaxSize {
+				err = errors.New(updateManifestName + ` is too large`)
+			}
+		case updateSignatureName:
+			signatureData, err = ioutil.ReadAll(io.LimitReader(tarReader, updateSignatureMaxSize+1))
+			if err == nil && len(signatureData) > updateSignatureMaxSize {
+				err = errors.New(updateSignatureName + ` is too large`)
+			}
+		default:
+			if _, found := hashes[name]; found {
+				return nil, errors.New(`archive holds '` + name + `' more than once`)
+			}
+			if header.Size > updateMaxFileSize {
+				return nil, errors.New(`'` + name + `' is too large`)
+			}
+			hash := sha256.New()
+			_, err = io.Copy(hash, tarReader)
+			hashes[name] = hex.EncodeToString(hash.Sum(nil))
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// Check the signature of the manifest
+	if manifestData == nil || signatureData == nil {
+		return nil, errors.New(`archive is not signed, ` + updateManifestName + ` or ` + updateSignatureName + ` is missing`)
+	}
+	signature, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(signatureData)))
+	if err != nil || len(signature) != ed25519.SignatureSize {
+		return nil, errors.New(updateSignatureName + ` is not a base64 encoded Ed25519 signature`)
+	}
+	if !ed25519.Verify(publicKey, manifestData, signature) {
+		return nil, errors.New(`invalid ` + updateManifestName + ` signature`)
+	}
+
+	// Check the archive files against the manifest
+	manifest := updateManifest{}
+	err = json.Unmarshal(manifestData, &manifest)
+	if err != nil {
+		return nil, errors.New(`cannot parse ` + updateManifestName + `: ` + err.Error())
+	}
+
+	listed := make(map[string]bool)
+	for _, file := range manifest.Files {
+		name := strings.TrimPrefix(file.Path, `./`)
+		hash, found := hashes[name]
+		if !found {
+			return nil, errors.New(`'` + file.Path + `' is listed in ` + updateManifestName + ` but missing from the archive`)
+		}
+		if !strings.EqualFold(hash, file.SHA256) {
+			return nil, errors.New(`'` + file.Path + `' SHA-256 does not match ` + updateManifestName)
+		}
+		listed[name] = true
+	}
+	for name := range hashes {
+		if !listed[name] {
+			return nil, errors.New(`'` + name + `' is not listed in ` + updateManifestName)
+		}
+	}
+
+	return &manifest, nil
+}
@@ -0,0 +1,155 @@
+package handler
+
+import (
+	"archive/tar"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"github.com/miky4u2/RAagent/agent/common"
+	"github.com/miky4u2/RAagent/agent/config"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// Builds a signed update archive holding files. The manifest lists listed,
+// with the SHA-256 of hashed, and is signed with key
+//
+func signedArchive(t *testing.T, archivePath string, key ed25519.PrivateKey, manifest updateManifest, files map[string]string, hashed map[string]string) {
+	t.Helper()
+	for name, body := range hashed {
+		hash := sha256.Sum256([]byte(body))
+		manifest.Files = append(manifest.Files, updateManifestFile{Path: name, SHA256: hex.EncodeToString(hash[:])})
+	}
+	manifestData, err := json.Marshal(manifest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signature := base64.StdEncoding.EncodeToString(ed25519.Sign(key, manifestData))
+
+	entries := []archiveEntry{
+		{name: updateManifestName, typeflag: tar.TypeReg, body: string(manifestData)},
+		{name: updateSignatureName, typeflag: tar.TypeReg, body: signature},
+	}
+	for name, body := range files {
+		entries = append(entries, archiveEntry{name: name, typeflag: tar.TypeReg, body: body})
+	}
+	writeArchive(t, archivePath, entries)
+}
+
+func TestVerifyUpdate(t *testing.T) {
+	publicKey, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, otherKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	hello := map[string]string{`modules/hello`: "hello\n"}
+	target := updateManifest{AgentID: `test-agent`, Type: `modules`, Version: config.Version, Serial: 10}
+	with := func(change func(m *updateManifest)) updateManifest {
+		m := target
+		change(&m)
+		return m
+	}
+
+	tests := []struct {
+		name     string
+		key      ed25519.PrivateKey
+		manifest updateManifest
+		files    map[string]string
+		hashed   map[string]string
+		err      string
+	}{
+		{`valid`, key, target, hello, hello, ``},
+		{`any agent`, key, with(func(m *updateManifest) { m.AgentID = `*` }), hello, hello, ``},
+		{`newer version`, key, with(func(m *updateManifest) { m.Version = `99.0` }), hello, hello, ``},
+		{`bad signature`, otherKey, target, hello, hello, `invalid manifest.json signature`},
+		{`hash mismatch`, key, target, map[string]string{`modules/hello`: "tampered\n"}, hello, `SHA-256 does not match`},
+		{`extra unhashed file`, key, target, map[string]string{`modules/hello`: "hello\n", `modules/extra`: "extra\n"}, hello, `is not listed`},
+		{`missing file`, key, target, map[string]string{}, hello, `missing from the archive`},
+		{`wrong agent`, key, with(func(m *updateManifest) { m.AgentID = `other-agent` }), hello, hello, `signed for agent 'other-agent'`},
+		{`wrong type`, key, with(func(m *updateManifest) { m.Type = `full` }), hello, hello, `signed for a 'full' update`},
+		{`downgrade`, key, with(func(m *updateManifest) { m.Version = `0.0.1` }), hello, hello, `older than the installed version`},
+		{`no version`, key, with(func(m *updateManifest) { m.Version = `` }), hello, hello, `has no version`},
+		{`no serial`, key, with(func(m *updateManifest) { m.Serial = 0 }), hello, hello, `has no serial`},
+		{`replayed serial`, key, with(func(m *updateManifest) { m.Serial = 5 }), hello, hello, `not greater than the last applied serial 5`},
+	}
+
+	for _, test := range tests {
+		basePath := setupBase(t)
+		config.Settings.AgentID = `test-agent`
+		config.Settings.UpdatePublicKey = base64.StdEncoding.EncodeToString(publicKey)
+		err = saveUpdateSerial(5)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		archivePath := filepath.Join(basePath, `temp`, `update.tar.gz`)
+		signedArchive(t, archivePath, test.key, test.manifest, test.files, test.hashed)
+		manifest, err := verifyUpdate(archivePath, `modules`)
+		if test.err == `` {
+			if err != nil {
+				t.Errorf(`%s: unexpected error %v`, test.name, err)
+			} else if len(manifest.Files) != len(test.hashed) {
+				t.Errorf(`%s: manifest lists %d files, want %d`, test.name, len(manifest.Files), len(test.hashed))
+			}
+			continue
+		}
+		if err == nil || !strings.Contains(err.Error(), test.err) {
+			t.Errorf(`%s: got error %v, want %q`, test.name, err, test.err)
+		}
+	}
+}
+
+func TestVerifyUnsignedUpdate(t *testing.T) {
+	basePath := setupBase(t)
+	archivePath := filepath.Join(basePath, `temp`, `update.tar.gz`)
+	writeArchive(t, archivePath, []archiveEntry{{name: `modules/hello`, typeflag: tar.TypeReg, body: "hello\n"}})
+
+	publicKey, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config.Settings.UpdatePublicKey = base64.StdEncoding.EncodeToString(publicKey)
+	_, err = verifyUpdate(archivePath, `modules`)
+	if err == nil || !strings.Contains(err.Error(), `archive is not signed`) {
+		t.Errorf(`got error %v for an unsigned archive, want 'archive is not signed'`, err)
+	}
+
+	config.Settings.UpdatePublicKey = ``
+	_, err = verifyUpdate(archivePath, `modules`)
+	if err == nil || !strings.Contains(err.Error(), `updates are disabled`) {
+		t.Errorf(`got error %v without updatePublicKey, want 'updates are disabled'`, err)
+	}
+}
+
+func TestCompareVersions(t *testing.T) {
+	tests := []struct {
+		a, b string
+		want int
+	}{
+		{`0.1.1`, `0.1.1`, 0},
+		{`0.1`, `0.1.0`, 0},
+		{`0.1.0`, `0.1.1`, -1},
+		{`0.2`, `0.1.9`, 1},
+		{`0.10.0`, `0.9.0`, 1},
+		{`1.0.0`, `0.99.99`, 1},
+	}
+	for _, test := range tests {
+		got, err := common.CompareVersions(test.a, test.b)
+		if err != nil || got != test.want {
+			t.Errorf(`CompareVersions(%q, %q) = %d, %v, want %d`, test.a, test.b, got, err, test.want)
+		}
+	}
+	for _, version := range []string{``, `1..2`, `v1.0`, `1.0-beta`, `1.-1`} {
+		if _, err := common.CompareVersions(version, `0.1.1`); err == nil {
+			t.Errorf(`CompareVersions(%q) did not fail`, version)
+		}
+	}
+}
@@ -0,0 +1,167 @@
+package handler
+
+import (
+	"crypto/tls"
+	"github.com/miky4u2/RAagent/agent/common"
+	"github.com/miky4u2/RAagent/agent/config"
+	"github.com/miky4u2/RAagent/agent/module"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Validates the staged files before they are installed
+//
+func validateStagedUpdate(stagePath string, updateType string) error {
+
+	// Module manifests must be valid
+	modulesPath := filepath.Join(stagePath, `modules`)
+	files, err := ioutil.ReadDir(modulesPath)
+	if err != nil {
+		return err
+	}
+	for _, f := range files {
+		if module.IsManifest(f.Name()) {
+			_, err = module.LoadManifest(modulesPath, strings.TrimSuffix(f.Name(), module.ManifestExt))
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	if updateType != `full` {
+		return nil
+	}
+
+	// The new config must load and the certificate must match its key
+	confPath := filepath.Join(stagePath, `conf`)
+	err = config.CheckFile(filepath.Join(confPath, `config.json`), confPath)
+	if err != nil {
+		return err
+	}
+	_, err = tls.LoadX509KeyPair(filepath.Join(confPath, `cert.pem`), filepath.Join(confPath, `key.pem`))
+	return err
+}
+
+// Installs the staged files. Current modules and conf folders are kept as
+// modules.prev and conf.prev, so that startagent can roll back a full update
+//
+func applyStagedUpdate(stagePath string, updateType string) error {
+	modulesPath := filepath.Join(config.AppBasePath, `modules`)
+	confPath := filepath.Join(config.AppBasePath, `conf`)
+	binPath := filepath.Join(config.AppBasePath, `bin`)
+
+	err := swapDir(modulesPath, filepath.Join(stagePath, `modules`))
+	if err != nil {
+		return err
+	}
+	if updateType != `full` {
+		return nil
+	}
+
+	err = swapDir(confPath, filepath.Join(stagePath, `conf`))
+	if err != nil {
+		restoreDir(modulesPath)
+		return err
+	}
+
+	// The new binary is installed by startagent once the agent has exited
+	for _, name := range []string{`agent.exe`, `agent`} {
+		stagedBin := filepath.Join(stagePath, `bin`, name)
+		if !common.FileExists(stagedBin) {
+			continue
+		}
+		log.Println(`Preparing executable update`)
+		err = os.Rename(stagedBin, filepath.Join(binPath, `update_`+name))
+		if err != nil {
+			restoreDir(confPath)
+			restoreDir(modulesPath)
+			return err
+		}
+	}
+
+	// Ask startagent to restart the agent, and to roll back if it does not come up healthy
+	for _, name := range []string{`agent_rollback`, `agent_restart`} {
+		emptyFile, err := os.Create(filepath.Join(binPath, name))
+		if err != nil {
+			return err
+		}
+		emptyFile.Close()
+	}
+
+	return nil
+}
+
+// Replaces a folder with a staged one, keeping the current folder as <folder>.prev
+//
+func swapDir(current string, staged string) error {
+	prev := current + `.prev`
+	err := os.RemoveAll(prev)
+	if err != nil {
+		return err
+	}
+	err = os.Rename(current, prev)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	err = os.Rename(staged, current)
+	if err != nil {
+		_ = os.Rename(prev, current)
+	}
+	return err
+}
+
+// Puts back the previous generation of a folder replaced by swapDir
+//
+func restoreDir(current string) {
+	err := os.RemoveAll(current)
+	if err == nil {
+		err = os.Rename(current+`.prev`, current)
+	}
+	if err != nil {
+		log.Println(`Error restoring`, current, `-`, err)
+	}
+}
+
+// Copies the regular files of a folder which are missing from another
+//
+func copyMissingFiles(src string, dest string) error {
+	files, err := ioutil.ReadDir(src)
+	if err != nil {
+		return err
+	}
+	for _, f := range files {
+		destPath := filepath.Join(dest, f.Name())
+		if !f.Mode().IsRegular() || common.FileExists(destPath) {
+			continue
+		}
+		err = copyFile(filepath.Join(src, f.Name()), destPath, f.Mode())
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Copies a file
+//
+func copyFile(src string, dest string, perms os.FileMode) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(dest, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, perms)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(out, in)
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
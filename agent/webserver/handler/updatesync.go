@@ -0,0 +1,159 @@
+package handler
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/miky4u2/RAagent/agent/config"
+	"github.com/miky4u2/RAagent/agent/module"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// errNoChanges is returned when the server has no changes for the agent
+var errNoChanges = errors.New(`no changes`)
+
+// Module file of the inventory sent to the server for sync updates
+type inventoryEntry struct {
+	Name   string `json:"name"`
+	SHA256 string `json:"sha256"`
+}
+
+// Sends the module inventory to the server and downloads the tar.gz archive of
+// the added and changed module files. Returns errNoChanges if modules are up to date
+//
+func downloadSyncFile(serverURL string, agentID string, destPath string) error {
+	inventory, err := moduleInventory(filepath.Join(config.AppBasePath, `modules`))
+	if err != nil {
+		return err
+	}
+
+	syncReq := struct {
+		AgentID string           `json:"agentID"`
+		Archive string           `json:"archive"`
+		Modules []inventoryEntry `json:"modules"`
+	}{agentID, `sync`, inventory}
+
+	syncReqBody, err := json.Marshal(syncReq)
+	if err != nil {
+		return err
+	}
+
+	return downloadArchive(serverURL+`/api/sync`, syncReqBody, destPath)
+}
+
+// Lists the module files, including those in module subfolders, with their SHA-256.
+// Protected modules are left out, they are managed locally
+//
+func moduleInventory(modulesPath string) ([]inventoryEntry, error) {
+	inventory := []inventoryEntry{}
+	err := filepath.Walk(modulesPath, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		name, err := filepath.Rel(modulesPath, path)
+		if err != nil {
+			return err
+		}
+		name = filepath.ToSlash(name)
+		if isProtectedModule(name) {
+			return nil
+		}
+		hash, err := module.FileSHA256(path)
+		if err != nil {
+			return err
+		}
+		inventory = append(inventory, inventoryEntry{Name: name, SHA256: hash})
+		return nil
+	})
+	return inventory, err
+}
+
+// Copies the current module files which must be kept into the staged modules folder.
+// Sync updates keep every file which is neither updated nor removed, other updates
+// replace all modules but protected ones. Staged files are never overwritten
+//
+func stageCurrentModules(stagePath string, updateType string, removed []string) error {
+	modulesPath := filepath.Join(config.AppBasePath, `modules`)
+	stagedModulesPath := filepath.Join(stagePath, `modules`)
+
+	return filepath.Walk(modulesPath, func(path string, info os.FileInfo, err error) error {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		name, err := filepath.Rel(modulesPath, path)
+		if err != nil || name == `.` {
+			return err
+		}
+		name = filepath.ToSlash(name)
+
+		keep := isProtectedModule(name)
+		if updateType == `sync` && !keep {
+			keep = !isRemoved(name, removed)
+			if !keep {
+				log.Println(`Removing module file:`, name)
+			}
+		}
+		if !keep {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		destPath := filepath.Join(stagedModulesPath, filepath.FromSlash(name))
+		if info.IsDir() {
+			return os.MkdirAll(destPath, info.Mode().Perm()|0700)
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		return copyMissingFile(path, destPath, info.Mode())
+	})
+}
+
+// Checks if a module file is covered by a removal entry, the file itself or one of its folders
+//
+func isRemoved(name string, removed []string) bool {
+	for _, entry := range removed {
+		entry = strings.TrimSuffix(strings.TrimPrefix(entry, `modules/`), `/`)
+		if name == entry || strings.HasPrefix(name, entry+`/`) {
+			return true
+		}
+	}
+	return false
+}
+
+// Checks if a module file belongs to a protected module. Module subfolders and
+// manifests are protected with their module
+//
+func isProtectedModule(name string) bool {
+	name = strings.TrimPrefix(name, `modules/`)
+	moduleName := strings.TrimSuffix(strings.SplitN(name, `/`, 2)[0], module.ManifestExt)
+	for _, pattern := range config.Settings.ProtectedModules {
+		if match, _ := filepath.Match(pattern, moduleName); match {
+			return true
+		}
+	}
+	return false
+}
+
+// Copies a file unless the destination already exists
+//
+func copyMissingFile(src string, dest string, perms os.FileMode) error {
+	if _, err := os.Stat(dest); err == nil {
+		return nil
+	}
+	err := os.MkdirAll(filepath.Dir(dest), 0700)
+	if err != nil {
+		return err
+	}
+	return copyFile(src, dest, perms)
+}
@@ -0,0 +1,158 @@
+package webserver
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"github.com/miky4u2/RAagent/agent/config"
+	"io/ioutil"
+	"log"
+	"math/big"
+	"net"
+	"os"
+	"strings"
+	"time"
+)
+
+// Validity of generated self-signed certificates
+const selfSignedValidity = 5 * 365 * 24 * time.Hour
+
+// SHA-256 of the public key of the sample key.pem once shipped with RAagent.
+// Its private key is public, it must not be used to serve requests
+const sampleKeyHash = `d17a8aeca220d86e3117b016538f0d7181dd6d404e9d7e32d39d7a1adbdf3dd8`
+
+// Generates an ECDSA key and a self-signed certificate when conf/cert.pem
+// or conf/key.pem is missing, so a fresh install can start
+//
+func bootstrapCertificate() error {
+	certPath, keyPath := certificatePaths()
+	_, certErr := os.Stat(certPath)
+	_, keyErr := os.Stat(keyPath)
+	if certErr == nil && keyErr == nil {
+		return nil
+	}
+	if !os.IsNotExist(certErr) && certErr != nil {
+		return certErr
+	}
+	if !os.IsNotExist(keyErr) && keyErr != nil {
+		return keyErr
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: config.Settings.AgentID},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.Add(selfSignedValidity),
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		DNSNames:              []string{config.Settings.AgentID},
+		IPAddresses:           bindIPs(),
+	}
+	hostname, err := os.Hostname()
+	if err == nil && hostname != config.Settings.AgentID {
+		template.DNSNames = append(template.DNSNames, hostname)
+	}
+
+	certDER, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return err
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return err
+	}
+
+	// Key first, a key without its certificate is generated again on the
+	// next start. Files are written aside and renamed, so a crash never
+	// leaves a partial file in place
+	err = writeFileAtomic(keyPath, pem.EncodeToMemory(&pem.Block{Type: `EC PRIVATE KEY`, Bytes: keyDER}), 0600)
+	if err != nil {
+		return err
+	}
+	err = writeFileAtomic(certPath, pem.EncodeToMemory(&pem.Block{Type: `CERTIFICATE`, Bytes: certDER}), 0644)
+	if err != nil {
+		return err
+	}
+
+	log.Println(`Generated self-signed TLS certificate for`, strings.Join(template.DNSNames, `, `), template.IPAddresses)
+	return nil
+}
+
+// Writes a file through a temporary file renamed in place
+//
+func writeFileAtomic(path string, data []byte, perm os.FileMode) error {
+	tmpPath := path + `.tmp`
+	err := ioutil.WriteFile(tmpPath, data, perm)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, path)
+}
+
+// Returns the IPs the agent listens on, every local IP when bound to all
+//
+func bindIPs() []net.IP {
+	ip := net.ParseIP(config.Settings.AgentBindIP)
+	if ip != nil && !ip.IsUnspecified() {
+		return []net.IP{ip}
+	}
+
+	var ips []net.IP
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		log.Println(`Cannot list local IPs :`, err)
+		return ips
+	}
+	for _, addr := range addrs {
+		if ipNet, ok := addr.(*net.IPNet); ok && !ipNet.IP.IsLinkLocalUnicast() {
+			ips = append(ips, ipNet.IP)
+		}
+	}
+	return ips
+}
+
+// Refuses the sample key unless allowSampleKey is set
+//
+func checkSampleKey(keyPair *tls.Certificate) error {
+	leaf, err := x509.ParseCertificate(keyPair.Certificate[0])
+	if err != nil {
+		return err
+	}
+	hash := sha256.Sum256(leaf.RawSubjectPublicKeyInfo)
+	if hex.EncodeToString(hash[:]) != sampleKeyHash || config.Settings.AllowSampleKey {
+		return nil
+	}
+	return errors.New(`conf/key.pem is the sample key shipped with RAagent, remove conf/cert.pem and conf/key.pem ` +
+		`to generate a new pair, or set 'allowSampleKey' to use it anyway`)
+}
+
+// Returns the SHA-256 fingerprint of a certificate, as printed by openssl
+//
+func fingerprint(keyPair *tls.Certificate) string {
+	hash := sha256.Sum256(keyPair.Certificate[0])
+	hexHash := strings.ToUpper(hex.EncodeToString(hash[:]))
+
+	var parts []string
+	for i := 0; i < len(hexHash); i += 2 {
+		parts = append(parts, hexHash[i:i+2])
+	}
+	return strings.Join(parts, `:`)
+}
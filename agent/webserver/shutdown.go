@@ -0,0 +1,36 @@
+package webserver
+
+import (
+	"context"
+	"github.com/miky4u2/RAagent/agent/config"
+	"github.com/miky4u2/RAagent/agent/lifecycle"
+	"github.com/miky4u2/RAagent/agent/webserver/handler/tasks"
+	"log"
+	"net/http"
+	"time"
+)
+
+// Time given to in-flight requests to complete once tasks are drained
+const shutdownTimeout = 10 * time.Second
+
+// Waits for the agent to be asked to stop, then drains it: new tasks are
+// refused, running tasks get up to drainTimeout seconds to end, and server,
+// if any, completes in-flight requests before it is closed
+//
+func drain(server *http.Server) {
+	<-lifecycle.Stopping()
+	log.Println(`Draining agent, new tasks are refused`)
+
+	tasks.Drain(time.Duration(config.Settings.DrainTimeout)*time.Second, lifecycle.Forced())
+	if server == nil {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	err := server.Shutdown(ctx)
+	if err != nil {
+		log.Println(`Closing remaining connections :`, err)
+		server.Close()
+	}
+}
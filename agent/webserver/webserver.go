@@ -1,11 +1,22 @@
 package webserver
 
 import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
 	"github.com/miky4u2/RAagent/agent/config"
+	"github.com/miky4u2/RAagent/agent/enroll"
+	"github.com/miky4u2/RAagent/agent/heartbeat"
+	"github.com/miky4u2/RAagent/agent/lifecycle"
 	"github.com/miky4u2/RAagent/agent/webserver/handler"
+	"github.com/miky4u2/RAagent/agent/webserver/handler/modules"
 	"github.com/miky4u2/RAagent/agent/webserver/handler/tasks"
 	"golang.org/x/time/rate"
+	"io/ioutil"
+	"log"
+	"net"
 	"net/http"
+	"os"
 	"path/filepath"
 )
 
@@ -18,25 +29,160 @@ func Start() error {
 	// Create a new Middleware rate limiter
 	limiter = rate.NewLimiter(rate.Limit(config.Settings.RateLimit), config.Settings.RateLimitBurst)
 
+	// Drain and stop on SIGTERM or interrupt
+	lifecycle.HandleSignals()
+
+	if config.Settings.UpdatePublicKey == "" {
+		log.Println(`No 'updatePublicKey' configured, update requests will be refused`)
+	}
+
+	// In pull mode, the agent may run without listening for requests
+	if config.Settings.AgentBindPort == "" {
+		err := startTasks()
+		if err != nil {
+			return err
+		}
+		markHealthy()
+		drain(nil)
+		return nil
+	}
+
 	// Set routing
 	mux := http.NewServeMux()
 	mux.HandleFunc("/tasks/new", tasks.New)
 	mux.HandleFunc("/tasks/status", tasks.Status)
+	mux.HandleFunc("/tasks/cancel", tasks.Cancel)
+	mux.HandleFunc("/tasks/stream", tasks.Stream)
+	mux.HandleFunc("/tasks/list", tasks.List)
+	mux.HandleFunc("/modules/list", modules.List)
+	mux.HandleFunc("/modules/info", modules.Info)
 	mux.HandleFunc("/update", handler.Update)
 	mux.HandleFunc("/ctl", handler.Ctl)
 
-	// TLS certificate and key paths
-	cert := filepath.Join(config.AppBasePath, "conf", "cert.pem")
-	key := filepath.Join(config.AppBasePath, "conf", "key.pem")
+	// Complete a certificate install interrupted by a crash
+	enroll.RecoverInstall()
+
+	// Enroll with RAserver and keep the certificate renewed, if enabled.
+	// Renewed certificates are served without a restart
+	err := enroll.Start(func() { reloadCertificate(`new certificate installed`) })
+	if err != nil {
+		return err
+	}
+
+	// Generate a self-signed certificate on first run, when none was enrolled
+	err = bootstrapCertificate()
+	if err != nil {
+		return err
+	}
+
+	// Hardened TLS settings, Go defaults apply to blank cipher suites and curves
+	tlsConfig := &tls.Config{}
+	tlsConfig.MinVersion, tlsConfig.CipherSuites, tlsConfig.CurvePreferences = config.Settings.TLSSettings()
+
+	// Verify client certificates against the configured CA bundle, if any
+	if config.Settings.ClientCAFile != "" {
+		tlsConfig.ClientCAs, err = loadCertPool(config.Settings.ClientCAFile)
+		if err != nil {
+			return err
+		}
+		tlsConfig.ClientAuth = tls.VerifyClientCertIfGiven
+		if config.Settings.RequireClientCert {
+			tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+		}
+	}
+
+	// Load TLS certificate, reloaded on file change or SIGHUP
+	err = loadCertificate()
+	if err != nil {
+		return err
+	}
+	tlsConfig.GetCertificate = getCertificate
+	go watchCertificate()
+
+	// Launch TLS HTTP server, startagent is told the agent is healthy once it listens.
+	// When asked to stop, the server is shut down once running tasks are drained
+	server := &http.Server{
+		Addr:      config.Settings.AgentBindIP + `:` + config.Settings.AgentBindPort,
+		Handler:   limit(mux),
+		TLSConfig: tlsConfig,
+	}
+	if config.Settings.DisableHTTP2 {
+		server.TLSNextProto = make(map[string]func(*http.Server, *tls.Conn, http.Handler))
+	}
+	listener, err := net.Listen("tcp", server.Addr)
+	if err != nil {
+		return err
+	}
 
-	// Launch TLS HTTP server
-	err := http.ListenAndServeTLS(config.Settings.AgentBindIP+`:`+config.Settings.AgentBindPort, cert, key, limit(mux))
+	// Tasks only start once the agent listens, so a failed start never
+	// leaves modules running
+	err = startTasks()
 	if err != nil {
+		listener.Close()
 		return err
 	}
+
+	markHealthy()
+	drained := make(chan struct{})
+	go func() {
+		drain(server)
+		close(drained)
+	}()
+	err = server.ServeTLS(listener, "", "")
+	if err == http.ErrServerClosed {
+		err = nil
+	} else {
+		// Running tasks are still drained if the server fails
+		log.Println(`HTTP server failed, stopping :`, err)
+		lifecycle.Stop(false)
+	}
+	<-drained
 	return err
 }
 
+// Starts the worker pool executing detached tasks, which recovers tasks
+// left by a previous run, the heartbeat and, in pull mode, the poller
+//
+func startTasks() error {
+	err := tasks.StartExecutor()
+	if err != nil {
+		return err
+	}
+
+	// Register with RAserver and send heartbeats
+	heartbeat.Start(func() (int, int) { return tasks.RunningCount(), tasks.QueuedCount() })
+
+	// Poll RAserver for tasks in pull mode
+	tasks.StartPoller()
+	return nil
+}
+
+// Creates the marker file startagent waits for after an update, before
+// the update rollback window expires
+//
+func markHealthy() {
+	emptyFile, err := os.Create(filepath.Join(config.AppBasePath, `bin`, `agent_healthy`))
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	emptyFile.Close()
+}
+
+// Loads a PEM bundle of CA certificates
+//
+func loadCertPool(path string) (*x509.CertPool, error) {
+	pem, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, errors.New(`no certificate found in ` + path)
+	}
+	return pool, nil
+}
+
 func limit(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		if !limiter.Allow() {
@@ -1,11 +1,14 @@
 package main
 
 import (
+	"encoding/json"
+	"io/ioutil"
 	"log"
 	"os"
 	"os/exec"
 	"path/filepath"
 	"strings"
+	"time"
 )
 
 // Version of start_agent
@@ -21,6 +24,7 @@ type processMonitor struct {
 	CmdArgs []string
 	Output  *[]byte
 	Err     error
+	Watched bool
 }
 
 func main() {
@@ -30,6 +34,7 @@ func main() {
 	appBasePath = filepath.Dir(appBasePath)
 
 	processStateListener := &processStateListener{monitor: make(chan bool)}
+	watchUpdate := false
 	for true {
 
 		agentRestart := false
@@ -38,26 +43,52 @@ func main() {
 		_ = os.Remove(filepath.Join(appBasePath, `agent_update.exe`))
 		_ = os.Remove(filepath.Join(appBasePath, `agent_update`))
 		_ = os.Remove(filepath.Join(appBasePath, `agent_restart`))
+		_ = os.Remove(filepath.Join(appBasePath, `agent_healthy`))
 
 		// Try to start the agent
+		var command *exec.Cmd
 		if fileExists(filepath.Join(appBasePath, `agent.exe`)) {
-			fork(processStateListener, filepath.Join(appBasePath, `agent.exe`))
+			command = fork(processStateListener, watchUpdate, filepath.Join(appBasePath, `agent.exe`))
 		} else if fileExists(filepath.Join(appBasePath, `agent`)) {
-			fork(processStateListener, filepath.Join(appBasePath, `agent`))
+			command = fork(processStateListener, watchUpdate, filepath.Join(appBasePath, `agent`))
 		} else {
 			log.Fatalln("Cannot find agent binary.")
 		}
 
+		// After an update, roll back to the previous generation if the agent
+		// does not come up healthy within the rollback window
+		if watchUpdate {
+			watchUpdate = false
+			if !waitHealthy(processStateListener, command, rollbackWindow()) {
+				rollbackUpdate()
+				continue
+			}
+			_ = os.Remove(filepath.Join(appBasePath, `agent_rollback`))
+		}
+
 		// waiting for monitor unblocking response when the agent exits gracefully
-		_ = <-processStateListener.monitor
+		if !<-processStateListener.monitor {
+			os.Exit(2)
+		}
+
+		// An update is being applied when the agent left the rollback marker
+		if fileExists(filepath.Join(appBasePath, `agent_rollback`)) {
+			watchUpdate = true
+			agentRestart = true
+
+			// The current binary is kept as previous generation when it is replaced below,
+			// drop an older one so that a rollback does not restore it
+			_ = os.Remove(filepath.Join(appBasePath, `agent.exe.prev`))
+			_ = os.Remove(filepath.Join(appBasePath, `agent.prev`))
+		}
 
 		// If an update binary exists, we assume that the agent placed it there and wishes to be updated and restarted
 		if fileExists(filepath.Join(appBasePath, `update_agent.exe`)) {
-			_ = os.Remove(filepath.Join(appBasePath, `agent.exe`))
+			_ = os.Rename(filepath.Join(appBasePath, `agent.exe`), filepath.Join(appBasePath, `agent.exe.prev`))
 			_ = os.Rename(filepath.Join(appBasePath, `update_agent.exe`), filepath.Join(appBasePath, `agent.exe`))
 			agentRestart = true
 		} else if fileExists(filepath.Join(appBasePath, `update_agent`)) {
-			_ = os.Remove(filepath.Join(appBasePath, `agent`))
+			_ = os.Rename(filepath.Join(appBasePath, `agent`), filepath.Join(appBasePath, `agent.prev`))
 			_ = os.Rename(filepath.Join(appBasePath, `update_agent`), filepath.Join(appBasePath, `agent`))
 			agentRestart = true
 		}
@@ -75,24 +106,99 @@ func main() {
 	}
 }
 
+// Waits for the agent to create its health marker. Returns false, after stopping
+// the agent if needed, when the agent exits or the window expires before that
+//
+func waitHealthy(processStateListener *processStateListener, command *exec.Cmd, window time.Duration) bool {
+	deadline := time.Now().Add(window)
+	for time.Now().Before(deadline) {
+		select {
+		case <-processStateListener.monitor:
+			log.Println("Agent exited before coming up healthy after update")
+			return false
+		case <-time.After(500 * time.Millisecond):
+			if fileExists(filepath.Join(appBasePath, `agent_healthy`)) {
+				return true
+			}
+		}
+	}
+
+	log.Println("Agent did not come up healthy within", window, "after update")
+	if command.Process != nil {
+		_ = command.Process.Kill()
+	}
+	<-processStateListener.monitor
+	return false
+}
+
+// Restores the previous generation of the agent binary, conf and modules
+// folders kept by the update
+//
+func rollbackUpdate() {
+	log.Println("Rolling back update")
+	basePath := filepath.Dir(appBasePath)
+	for _, path := range []string{
+		filepath.Join(appBasePath, `agent.exe`),
+		filepath.Join(appBasePath, `agent`),
+		filepath.Join(basePath, `conf`),
+		filepath.Join(basePath, `modules`),
+	} {
+		if !fileExists(path + `.prev`) {
+			continue
+		}
+		_ = os.RemoveAll(path + `.failed`)
+		_ = os.Rename(path, path+`.failed`)
+		err := os.Rename(path+`.prev`, path)
+		if err != nil {
+			log.Println("Error rolling back", path, ":", err)
+		}
+	}
+	_ = os.Remove(filepath.Join(appBasePath, `agent_rollback`))
+}
+
+// Reads the update rollback window from the agent config file, defaults to 30 seconds
+//
+func rollbackWindow() time.Duration {
+	settings := struct {
+		UpdateRollbackWindow int `json:"updateRollbackWindow"`
+	}{}
+	configFile, err := ioutil.ReadFile(filepath.Join(filepath.Dir(appBasePath), `conf`, `config.json`))
+	if err == nil {
+		_ = json.Unmarshal(configFile, &settings)
+	}
+	if settings.UpdateRollbackWindow < 1 {
+		settings.UpdateRollbackWindow = 30
+	}
+	return time.Duration(settings.UpdateRollbackWindow) * time.Second
+}
+
 // Forks a process for given command.
-// Returns a processMonitor to the processStateListener
-func fork(processStateListener *processStateListener, cmdName string, cmdArgs ...string) {
+// Returns a processMonitor to the processStateListener. When watched, errors
+// are reported to the listener instead of ending startagent
+func fork(processStateListener *processStateListener, watched bool, cmdName string, cmdArgs ...string) *exec.Cmd {
+	processMonitor := &processMonitor{
+		CmdArgs: cmdArgs,
+		CmdName: cmdName,
+		Watched: watched,
+	}
+	args := strings.Join(cmdArgs, ",")
+	command := exec.Command(cmdName, args)
+	err := command.Start()
+	if err != nil {
+		processMonitor.Err = err
+		go processStateListener.OnError(processMonitor)
+		return command
+	}
 	go func() {
-		processMonitor := &processMonitor{
-			CmdArgs: cmdArgs,
-			CmdName: cmdName,
-		}
-		args := strings.Join(cmdArgs, ",")
-		command := exec.Command(cmdName, args)
-		output, err := command.Output()
+		err := command.Wait()
 		if err != nil {
 			processMonitor.Err = err
 			processStateListener.OnError(processMonitor)
+			return
 		}
-		processMonitor.Output = &output
 		processStateListener.OnComplete(processMonitor)
 	}()
+	return command
 }
 
 // ProcessStateListener type
@@ -111,7 +217,10 @@ func (processStateListener *processStateListener) OnComplete(processMonitor *pro
 //
 func (processStateListener *processStateListener) OnError(processMonitor *processMonitor) {
 	log.Println("Error starting agent:", processMonitor.Err)
-	os.Exit(2)
+	if !processMonitor.Watched {
+		os.Exit(2)
+	}
+	processStateListener.monitor <- false
 }
 
 // fileExists checks if a file exists